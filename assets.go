@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Embedded static files are loaded once at startup, and gzip and Brotli
+// variants are precompressed in the background. Each response carries a
+// content-hash ETag, and URLs built with the "asset" template function include
+// that hash so browsers can cache them for a year
+type staticAsset struct {
+	contentType string
+	hash        string
+	identity    []byte
+	compressed  atomic.Pointer[compressedAsset] // nil until precompression finishes
+}
+
+type compressedAsset struct {
+	gzip   []byte // nil when compression doesn't pay off
+	brotli []byte
+}
+
+const (
+	cacheImmutable  = "public, max-age=31536000, immutable" // versioned URLs
+	cacheDay        = "public, max-age=86400"
+	cacheRevalidate = "no-cache" // always checked against the ETag
+)
+
+// Paths served outside /static/, kept at the root for older pages and PWA installs
+var assetRoutes = []struct {
+	path         string
+	file         string
+	cacheControl string
+}{
+	{"/style.css", "style.css", cacheRevalidate},
+	{"/md.js", "md.js", cacheRevalidate},
+	{"/manifest.json", "manifest.json", cacheRevalidate},
+	{"/sw.js", "sw.js", cacheRevalidate}, // a stale service worker can't be fixed by the page
+	{"/favicon.ico", "favicon.ico", cacheDay},
+	{"/icon-192.png", "icon-192.png", cacheDay},
+	{"/icon-512.png", "icon-512.png", cacheDay},
+}
+
+var staticAssets = map[string]*staticAsset{}
+
+func initStaticAssets(staticFS fs.FS) {
+	err := fs.WalkDir(staticFS, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(staticFS, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		staticAssets[name] = &staticAsset{
+			contentType: assetContentType(name),
+			hash:        hex.EncodeToString(sum[:8]),
+			identity:    data,
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to load static assets: %v", err)
+	}
+	// Compressing the fonts and scripts takes about a second, so assets are
+	// served uncompressed until it's done rather than delaying startup
+	go compressStaticAssets()
+}
+
+func compressStaticAssets() {
+	start := time.Now()
+	var raw, compressed int
+	for _, asset := range staticAssets {
+		data := asset.identity
+		variants := &compressedAsset{}
+		var gz bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+		zw.Write(data)
+		if zw.Close() == nil && worthCompressing(int64(len(data)), int64(gz.Len())) {
+			variants.gzip = gz.Bytes()
+		}
+		var br bytes.Buffer
+		// Level 9 is within a few percent of the maximum at a twentieth of the time
+		bw := brotli.NewWriterLevel(&br, 9)
+		bw.Write(data)
+		if bw.Close() == nil && worthCompressing(int64(len(data)), int64(br.Len())) {
+			variants.brotli = br.Bytes()
+		}
+		asset.compressed.Store(variants)
+		raw += len(data)
+		switch {
+		case variants.brotli != nil:
+			compressed += len(variants.brotli)
+		case variants.gzip != nil:
+			compressed += len(variants.gzip)
+		default:
+			compressed += len(data)
+		}
+	}
+	log.Printf("Precompressed static assets (%s to %s) in %v", formatBytes(int64(raw)), formatBytes(int64(compressed)), time.Since(start).Round(time.Millisecond))
+}
+
+func assetContentType(name string) string {
+	ctype, ok := contentTypesByExt[strings.ToLower(path.Ext(name))]
+	if !ok {
+		if ctype = mime.TypeByExtension(path.Ext(name)); ctype == "" {
+			return "application/octet-stream"
+		}
+	}
+	if strings.HasPrefix(ctype, "text/") && !strings.Contains(ctype, "charset") {
+		ctype += "; charset=utf-8"
+	}
+	return ctype
+}
+
+// Template function returning a cache-busting URL for a static file
+func assetURL(name string) string {
+	if asset, ok := staticAssets[name]; ok {
+		return "/static/" + name + "?v=" + asset.hash
+	}
+	return "/static/" + name
+}
+
+// Serves everything under /static/, with versioned URLs cached for a year
+func handleStaticAsset(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	asset, ok := staticAssets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	cacheControl := cacheDay
+	if v := r.URL.Query().Get("v"); v == asset.hash {
+		cacheControl = cacheImmutable
+	} else if v != "" {
+		// A page built against another version; make sure it's fetched fresh next time
+		cacheControl = cacheRevalidate
+	}
+	serveStaticAsset(w, r, asset, cacheControl)
+}
+
+// Serves a root-level path from the assetRoutes table
+func assetRouteHandler(file, cacheControl string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		asset, ok := staticAssets[file]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		serveStaticAsset(w, r, asset, cacheControl)
+	}
+}
+
+// Picks the smallest variant the client accepts; each encoding gets its own
+// ETag so caches never mix them up
+func serveStaticAsset(w http.ResponseWriter, r *http.Request, asset *staticAsset, cacheControl string) {
+	body, encoding := asset.identity, ""
+	variants := asset.compressed.Load()
+	if variants != nil && variants.brotli != nil && acceptsEncoding(r, "br") {
+		body, encoding = variants.brotli, "br"
+	} else if variants != nil && variants.gzip != nil && acceptsEncoding(r, "gzip") {
+		body, encoding = variants.gzip, "gzip"
+	}
+	etag := asset.hash
+	if encoding != "" {
+		etag += "-" + encoding
+		w.Header().Set("Content-Encoding", encoding)
+		// ServeContent leaves the length out for encoded bodies
+		if r.Header.Get("Range") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("Content-Type", asset.contentType)
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// File bodies are stored once under data/blobs/<2 hex chars>/<sha256> (with a
+// .gz suffix when compressed) and hard-linked into data/files, so identical
+// uploads share a single copy
+type BlobStore struct {
+	refs map[string]int // number of file entries pointing at each blob key
+	mu   sync.Mutex
+}
+
+var blobStore *BlobStore
+
+func initBlobStore() *BlobStore {
+	store := &BlobStore{refs: make(map[string]int)}
+	if err := os.MkdirAll(filepath.Join("data", "blobs", "tmp"), 0755); err != nil {
+		log.Fatal(err)
+	}
+	// Leftovers from interrupted uploads
+	tmpFiles, _ := os.ReadDir(filepath.Join("data", "blobs", "tmp"))
+	for _, f := range tmpFiles {
+		os.Remove(filepath.Join("data", "blobs", "tmp", f.Name()))
+	}
+	metadataTracker.mu.Lock()
+	for _, meta := range metadataTracker.Entries {
+		if meta.Hash != "" {
+			store.refs[blobKey(meta.Hash, meta.Encoding)]++
+		}
+	}
+	metadataTracker.mu.Unlock()
+	store.migrateFiles()
+	store.removeOrphans()
+	return store
+}
+
+// Names a blob by content hash and storage encoding, so compressed and raw
+// copies of the same content never stand in for each other
+func blobKey(hash, encoding string) string {
+	if encoding == "gzip" {
+		return hash + ".gz"
+	}
+	return hash
+}
+
+func blobPath(key string) string {
+	return filepath.Join("data", "blobs", key[:2], key)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Creates a temporary upload file; the extension is kept for format-specific processing
+func (b *BlobStore) CreateTemp(ext string) (*os.File, error) {
+	return os.CreateTemp(filepath.Join("data", "blobs", "tmp"), "upload-*"+ext)
+}
+
+// Moves a finished temporary file into the store and links it at dst,
+// returning the content hash; hash may be passed in if already known and must
+// be for compressed files, whose hash is of the decoded content
+func (b *BlobStore) Commit(tmpPath, dst, hash, encoding string) (string, error) {
+	if hash == "" {
+		var err error
+		if hash, err = hashFile(tmpPath); err != nil {
+			os.Remove(tmpPath)
+			return "", err
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := blobKey(hash, encoding)
+	blob := blobPath(key)
+	if _, err := os.Stat(blob); err == nil {
+		os.Remove(tmpPath)
+		log.Printf("Deduplicated %s against existing blob %s", filepath.Base(dst), hash)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			os.Remove(tmpPath)
+			return "", err
+		}
+		if err := os.Rename(tmpPath, blob); err != nil {
+			os.Remove(tmpPath)
+			return "", err
+		}
+	}
+	if err := linkOrCopy(blob, dst); err != nil {
+		if b.refs[key] == 0 {
+			os.Remove(blob)
+		}
+		return "", err
+	}
+	b.refs[key]++
+	invalidateDataUsage()
+	return hash, nil
+}
+
+// Drops one reference to a blob and removes it once nothing points at it
+func (b *BlobStore) Release(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refs[key]--
+	if b.refs[key] > 0 {
+		return
+	}
+	delete(b.refs, key)
+	if err := os.Remove(blobPath(key)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing blob %s: %v", key, err)
+	}
+	invalidateDataUsage()
+}
+
+// Hard-links src to dst, copying instead on filesystems without hard links
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	} else if _, statErr := os.Stat(dst); statErr == nil {
+		return err
+	}
+	log.Printf("Hard link failed for %s, storing a copy instead", dst)
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// Moves files stored before deduplication existed into the blob store
+func (b *BlobStore) migrateFiles() {
+	files, _ := os.ReadDir(filepath.Join("data", "files"))
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		id := filepath.Join("files", file.Name())
+		if meta := metadataTracker.Get(id); meta != nil && meta.Hash != "" {
+			continue
+		}
+		path := filepath.Join("data", id)
+		hash, err := hashFile(path)
+		if err != nil {
+			log.Printf("Error hashing %s: %v", id, err)
+			continue
+		}
+		blob := blobPath(hash)
+		if _, err := os.Stat(blob); err == nil {
+			// Replace the duplicate with a link to the existing blob
+			tmpPath := path + ".dedup"
+			if err := os.Rename(path, tmpPath); err != nil {
+				continue
+			}
+			if err := linkOrCopy(blob, path); err != nil {
+				os.Rename(tmpPath, path)
+				continue
+			}
+			os.Remove(tmpPath)
+		} else {
+			if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+				continue
+			}
+			if err := os.Link(path, blob); err != nil {
+				log.Printf("Error linking %s into blob store: %v", id, err)
+				continue
+			}
+		}
+		b.refs[hash]++
+		metadataTracker.Update(id, func(meta *EntryMeta) { meta.Hash = hash })
+		log.Printf("Indexed %s as blob %s", id, hash)
+	}
+}
+
+// Removes blobs that no entry references, e.g. after a crash mid-delete
+func (b *BlobStore) removeOrphans() {
+	dirs, _ := os.ReadDir(filepath.Join("data", "blobs"))
+	for _, dir := range dirs {
+		if !dir.IsDir() || dir.Name() == "tmp" {
+			continue
+		}
+		blobs, _ := os.ReadDir(filepath.Join("data", "blobs", dir.Name()))
+		for _, blob := range blobs {
+			if b.refs[blob.Name()] == 0 {
+				os.Remove(filepath.Join("data", "blobs", dir.Name(), blob.Name()))
+				log.Printf("Removed unreferenced blob %s", blob.Name())
+			}
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Notepads are edited live by everyone who has them open. Each client sends
+// its edits as text operations based on the last revision it has seen; the
+// server transforms them past any revisions they missed, applies them, and
+// sends the result to the room as a notepad.op event, which is also how the
+// sender learns its edit went through. Cursors are shared the same way.
+// These events are not kept for replay: clients catch up with /sync
+const (
+	eventNotepadOp     = "notepad.op"
+	eventNotepadCursor = "notepad.cursor"
+)
+
+const (
+	notepadLogSize       = 1000 // revisions kept for clients that fall behind
+	notepadSaveInterval  = 2 * time.Second
+	notepadIdleTimeout   = 10 * time.Minute // unused docs are unloaded after this
+	notepadMaxOpRequest  = 32 << 20
+	notepadMaxClientName = 64
+)
+
+var (
+	errNotepadStale  = errors.New("revision is no longer known")
+	errNotepadClosed = errors.New("notepad was renamed or deleted")
+)
+
+// A committed edit
+type NotepadRevision struct {
+	Rev    int    `json:"rev"`
+	Op     TextOp `json:"op"`
+	Client string `json:"client,omitempty"` // the tab that made it, empty for whole saves
+}
+
+// A notepad loaded for editing. Revisions restart from 0 in a new session
+// whenever it's loaded, so clients can tell their revisions apart
+type notepadDoc struct {
+	id      string
+	session string
+	rev     int
+	text    []uint16
+	log     []NotepadRevision // the latest revisions, ending at rev
+	dirty   bool
+	closed  bool       // set once the notepad is renamed, deleted, or unloaded
+	used    time.Time  // last handed out by Get
+	saveErr error      // why the last save failed, refusing growth until one works
+	mu      sync.Mutex // mutex for thread safety
+	saveMu  sync.Mutex // keeps saves in order
+}
+
+type NotepadDocs struct {
+	docs map[string]*notepadDoc // by entry ID
+	mu   sync.Mutex
+}
+
+var notepadDocs *NotepadDocs
+
+func initNotepadDocs() *NotepadDocs {
+	docs := &NotepadDocs{docs: make(map[string]*notepadDoc)}
+	go docs.saveLoop()
+	return docs
+}
+
+// Returns a notepad's live document, loading it on first use
+func (n *NotepadDocs) Get(id string) (*notepadDoc, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if doc, ok := n.docs[id]; ok {
+		doc.used = time.Now()
+		return doc, nil
+	}
+	content, err := readEntryContent(id)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	doc := &notepadDoc{
+		id:      id,
+		session: hex.EncodeToString(buf),
+		text:    utf16.Encode([]rune(string(content))),
+		used:    time.Now(),
+	}
+	n.docs[id] = doc
+	return doc, nil
+}
+
+// Takes a notepad's live document out of use before the notepad is renamed
+// or deleted, writing out pending edits first if save is set. Edits sent to
+// it from then on fail, and the notepad is loaded afresh if needed again
+func (n *NotepadDocs) Close(id string, save bool) error {
+	n.mu.Lock()
+	doc, ok := n.docs[id]
+	delete(n.docs, id)
+	n.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	// Waits for a save in progress, which could otherwise bring back a
+	// deleted notepad
+	doc.saveMu.Lock()
+	defer doc.saveMu.Unlock()
+	doc.mu.Lock()
+	doc.closed = true
+	doc.mu.Unlock()
+	if !save {
+		return nil
+	}
+	return doc.saveLocked()
+}
+
+// Writes out the notepads edited since their last save, and unloads those
+// left idle
+func (n *NotepadDocs) saveLoop() {
+	ticker := time.NewTicker(notepadSaveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n.mu.Lock()
+		docs := make([]*notepadDoc, 0, len(n.docs))
+		for _, doc := range n.docs {
+			docs = append(docs, doc)
+		}
+		n.mu.Unlock()
+		for _, doc := range docs {
+			if err := doc.save(); err != nil {
+				log.Printf("Error saving notepad %s: %v", doc.id, err)
+			}
+		}
+		n.unloadIdle()
+	}
+}
+
+// Drops the documents of notepads that no one has used for a while and whose
+// room no one is following. Only saved ones go, so loading one again reads
+// what it held; a Get refreshes the time used, so none is dropped while in use
+func (n *NotepadDocs) unloadIdle() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for id, doc := range n.docs {
+		if time.Since(doc.used) < notepadIdleTimeout || hub.Subscribers(entryRoomKey(id)) > 0 {
+			continue
+		}
+		doc.mu.Lock()
+		if !doc.dirty {
+			doc.closed = true
+			delete(n.docs, id)
+		}
+		doc.mu.Unlock()
+	}
+}
+
+// The document's session, revision and text
+func (d *notepadDoc) Snapshot() (string, int, string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.session, d.rev, string(utf16.Decode(d.text))
+}
+
+// Applies a client's operation made at rev, returning the new revision
+func (d *notepadDoc) Apply(session string, rev int, op TextOp, client string) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return 0, errNotepadClosed
+	}
+	if session != d.session || rev > d.rev || rev < d.rev-len(d.log) {
+		return 0, errNotepadStale
+	}
+	var err error
+	for _, past := range d.log[len(d.log)-(d.rev-rev):] {
+		if op, _, err = TransformOps(op, past.Op); err != nil {
+			return 0, err
+		}
+	}
+	text, err := op.Apply(d.text)
+	if err != nil {
+		return 0, err
+	}
+	if len(text) > len(d.text) {
+		if d.saveErr != nil {
+			return 0, d.saveErr
+		}
+		if err := checkSnippetSize(utf16Size(text)); err != nil {
+			return 0, err
+		}
+	}
+	return d.commitLocked(op, client, text), nil
+}
+
+// Replaces the whole text, as an edit from no client, unless ifMatch (an
+// If-Match header) doesn't match it. Returns whether it was replaced with the
+// text as stored, or else the text it was checked against. Like other edits,
+// it can't grow the text while saves are failing
+func (d *notepadDoc) Replace(content, ifMatch string) (string, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return "", false, errNotepadClosed
+	}
+	current := string(utf16.Decode(d.text))
+	if !ifMatchAllows(ifMatch, contentETag([]byte(current)), true) {
+		return current, false, nil
+	}
+	text := utf16.Encode([]rune(content))
+	if len(text) > len(d.text) && d.saveErr != nil {
+		return current, false, d.saveErr
+	}
+	d.commitLocked(ReplaceOp(d.text, text), "", text)
+	return string(utf16.Decode(text)), true, nil
+}
+
+// Records a revision and sends it to the notepad's room. Called with d.mu held
+func (d *notepadDoc) commitLocked(op TextOp, client string, text []uint16) int {
+	d.text = text
+	d.rev++
+	d.dirty = true
+	revision := NotepadRevision{Rev: d.rev, Op: op, Client: client}
+	d.log = append(d.log, revision)
+	if len(d.log) > notepadLogSize {
+		d.log = d.log[len(d.log)-notepadLogSize:]
+	}
+	data, err := json.Marshal(struct {
+		ID      string `json:"id"`
+		Session string `json:"session"`
+		NotepadRevision
+	}{d.id, d.session, revision})
+	if err != nil {
+		log.Printf("Error marshaling %s event: %v", eventNotepadOp, err)
+	} else {
+		hub.Broadcast(entryRoomKey(d.id), sseMessage{Event: eventNotepadOp, Data: string(data)})
+	}
+	return d.rev
+}
+
+// Returns the revisions after rev, or false if they're not all kept
+func (d *notepadDoc) Since(session string, rev int) ([]NotepadRevision, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if session != d.session || rev > d.rev || rev < d.rev-len(d.log) {
+		return nil, false
+	}
+	return append([]NotepadRevision{}, d.log[len(d.log)-(d.rev-rev):]...), true
+}
+
+// Writes the text if it changed since the last save. Closed documents were
+// written out by Close
+func (d *notepadDoc) save() error {
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+	d.mu.Lock()
+	closed := d.closed
+	d.mu.Unlock()
+	if closed {
+		return nil
+	}
+	return d.saveLocked()
+}
+
+// Called with d.saveMu held
+func (d *notepadDoc) saveLocked() error {
+	d.mu.Lock()
+	if !d.dirty {
+		d.mu.Unlock()
+		return nil
+	}
+	content := []byte(string(utf16.Decode(d.text)))
+	d.dirty = false
+	d.mu.Unlock()
+	err := checkStorageAvailable(int64(len(content)))
+	if err == nil {
+		_, err = writeEntryContent(d.id, content)
+	}
+	d.mu.Lock()
+	d.saveErr = err
+	if err != nil {
+		d.dirty = true
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	searchIndex.Update(d.id)
+	publishNotepadEvent(eventNotepadUpdated, d.id, "")
+	log.Printf("Saved notepad content to %s\n", d.id)
+	return nil
+}
+
+// Size of UTF-16 text once encoded as UTF-8
+func utf16Size(text []uint16) int {
+	size := 0
+	for _, r := range utf16.Decode(text) {
+		size += utf8.RuneLen(r)
+	}
+	return size
+}
+
+// Serves POST /notepad/<name>.file/op, /sync, and /cursor, which take and return JSON:
+//   - op applies {"session", "rev", "op", "client"} and returns the new
+//     {"session", "rev"}, or 409 with the whole {"session", "rev", "text"} if
+//     rev is too old to transform
+//   - sync returns the {"session", "rev", "ops"} after {"session", "rev"}, or
+//     the whole text like op's 409
+//   - cursor shares {"client", "start", "end"} with the room
+func handleNotepadCollab(w http.ResponseWriter, r *http.Request, id, action string) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Session string `json:"session"`
+		Rev     int    `json:"rev"`
+		Op      TextOp `json:"op"`
+		Client  string `json:"client"`
+		Start   int    `json:"start"`
+		End     int    `json:"end"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, notepadMaxOpRequest)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Client) > notepadMaxClientName {
+		http.Error(w, "Client ID is too long", http.StatusBadRequest)
+		return
+	}
+	doc, err := notepadDocs.Get(id)
+	if os.IsNotExist(err) {
+		http.Error(w, "Notepad not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Error reading notepad file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	switch action {
+	case "op":
+		rev, err := doc.Apply(req.Session, req.Rev, req.Op, req.Client)
+		switch {
+		case errors.Is(err, errNotepadClosed):
+			http.Error(w, "Notepad not found", http.StatusNotFound)
+		case errors.Is(err, errNotepadStale):
+			writeNotepadSnapshot(w, doc, http.StatusConflict)
+		case errors.Is(err, errOpMismatch):
+			http.Error(w, "Operation does not match the notepad", http.StatusBadRequest)
+		case err != nil:
+			writeStorageError(w, err)
+		default:
+			json.NewEncoder(w).Encode(map[string]any{"session": req.Session, "rev": rev})
+		}
+	case "sync":
+		revisions, ok := doc.Since(req.Session, req.Rev)
+		if !ok {
+			writeNotepadSnapshot(w, doc, http.StatusOK)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"session": req.Session, "rev": req.Rev + len(revisions), "ops": revisions})
+	case "cursor":
+		device := deviceOwner(w, r)
+		data, _ := json.Marshal(map[string]any{
+			"id":     id,
+			"client": req.Client,
+			"device": device,
+			"name":   deviceTracker.Name(device),
+			"start":  req.Start,
+			"end":    req.End,
+		})
+		hub.Broadcast(entryRoomKey(id), sseMessage{Event: eventNotepadCursor, Data: string(data)})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func writeNotepadSnapshot(w http.ResponseWriter, doc *notepadDoc, status int) {
+	session, rev, text := doc.Snapshot()
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"session": session, "rev": rev, "text": text})
+}
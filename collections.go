@@ -0,0 +1,411 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Collections group related snippets, files, and links under a name. An entry
+// belongs to at most one collection, recorded in its metadata, while the
+// collections themselves are kept in data/collections.json
+type Collection struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Expiry  string    `json:"expiry,omitempty"` // default expiry option for new entries
+	Room    string    `json:"room,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type CollectionCount struct {
+	Collection
+	Count int `json:"count"`
+}
+
+type CollectionTracker struct {
+	Collections map[string]*Collection `json:"collections"`
+	mu          sync.Mutex             // mutex for thread safety
+}
+
+const maxCollectionNameLength = 64
+
+var collectionTracker *CollectionTracker
+
+var customExpiryPattern = regexp.MustCompile(`^\d+[hmMdwy]$`)
+
+func initCollectionTracker() *CollectionTracker {
+	tracker := &CollectionTracker{
+		Collections: make(map[string]*Collection),
+	}
+	collectionsFile := filepath.Join("data", "collections.json")
+	if data, err := os.ReadFile(collectionsFile); err == nil {
+		var storedTracker CollectionTracker
+		if err := json.Unmarshal(data, &storedTracker); err == nil && storedTracker.Collections != nil {
+			tracker.Collections = storedTracker.Collections
+		}
+	}
+	return tracker
+}
+
+// Returns a copy of a collection, or nil if it doesn't exist
+func (t *CollectionTracker) Get(id string) *Collection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	collection, ok := t.Collections[id]
+	if !ok {
+		return nil
+	}
+	collectionCopy := *collection
+	return &collectionCopy
+}
+
+// Lists collections by name
+func (t *CollectionTracker) List() []Collection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	collections := make([]Collection, 0, len(t.Collections))
+	for _, collection := range t.Collections {
+		collections = append(collections, *collection)
+	}
+	sort.Slice(collections, func(i, j int) bool {
+		return strings.ToLower(collections[i].Name) < strings.ToLower(collections[j].Name)
+	})
+	return collections
+}
+
+// Creates a collection with an ID derived from its name
+func (t *CollectionTracker) Create(name, expiry, room string) *Collection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	base := collectionSlug(name)
+	id := base
+	for i := 2; t.Collections[id] != nil; i++ {
+		id = fmt.Sprintf("%s-%d", base, i)
+	}
+	collection := &Collection{ID: id, Name: name, Expiry: expiry, Room: room, Created: time.Now()}
+	t.Collections[id] = collection
+	t.saveToFile()
+	collectionCopy := *collection
+	return &collectionCopy
+}
+
+// Applies fn to a collection and persists it, reporting whether it exists
+func (t *CollectionTracker) Update(id string, fn func(collection *Collection)) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	collection, ok := t.Collections[id]
+	if !ok {
+		return false
+	}
+	fn(collection)
+	t.saveToFile()
+	return true
+}
+
+func (t *CollectionTracker) Delete(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.Collections, id)
+	t.saveToFile()
+}
+
+func (t *CollectionTracker) saveToFile() {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		log.Printf("Error marshaling collections: %v", err)
+		return
+	}
+	collectionsFile := filepath.Join("data", "collections.json")
+	if err := os.WriteFile(collectionsFile, data, 0644); err != nil {
+		log.Printf("Error saving collections: %v", err)
+	}
+}
+
+// Turns a name into a URL-friendly ID, e.g. "Trip Planning" into "trip-planning"
+func collectionSlug(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	slug := strings.TrimSuffix(b.String(), "-")
+	if slug == "" {
+		return "collection"
+	}
+	return slug
+}
+
+// Validates a collection name and default expiry from a form
+func parseCollectionForm(r *http.Request) (string, string, error) {
+	name := strings.Join(strings.Fields(r.FormValue("name")), " ")
+	if name == "" {
+		return "", "", fmt.Errorf("collection name cannot be empty")
+	}
+	if len([]rune(name)) > maxCollectionNameLength {
+		return "", "", fmt.Errorf("collection names are limited to %d characters", maxCollectionNameLength)
+	}
+	expiry, err := parseExpiryOption(r.FormValue("expiry"))
+	return name, expiry, err
+}
+
+func filterEntriesByCollection(entries []Entry, collection string) []Entry {
+	filtered := []Entry{}
+	for _, entry := range entries {
+		if entry.Collection == collection {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// Lists a room's collections with the number of entries in each
+func collectionCounts(room *Room, entries []Entry) []CollectionCount {
+	counts := map[string]int{}
+	for _, entry := range entries {
+		if entry.Collection != "" {
+			counts[entry.Collection]++
+		}
+	}
+	result := []CollectionCount{}
+	for _, collection := range collectionTracker.List() {
+		if collection.Room == room.Key() {
+			result = append(result, CollectionCount{collection, counts[collection.ID]})
+		}
+	}
+	return result
+}
+
+// Lists collections with their entry counts
+func handleCollectionList(w http.ResponseWriter, r *http.Request) {
+	expirationTracker.CleanupExpired()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	room := roomFromRequest(r)
+	json.NewEncoder(w).Encode(collectionCounts(room, visibleEntries(listEntries(room), deviceOwner(w, r))))
+}
+
+// Creates a collection from the "name" and optional "expiry" form fields
+func handleCreateCollection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, expiry, err := parseCollectionForm(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	room := roomFromRequest(r)
+	collection := collectionTracker.Create(name, expiry, room.Key())
+	notifyContentChange(room.Key())
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(collection)
+	} else {
+		http.Redirect(w, r, room.Path()+"/collections/"+collection.ID, http.StatusSeeOther)
+	}
+	log.Printf("Created collection %s\n", collection.ID)
+}
+
+// Serves a collection's page, and its settings, archive, and delete actions:
+//
+//	GET  /collections/<id>          the collection's listing
+//	POST /collections/<id>          rename it or change its default expiry
+//	GET  /collections/<id>/archive  download its entries as a zip file
+//	POST /collections/<id>/delete   delete it, and its entries with contents=true
+func handleCollection(tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/collections/"), "/")
+		room := roomFromRequest(r)
+		collection := collectionTracker.Get(id)
+		if collection == nil || collection.Room != room.Key() {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return
+		}
+		switch {
+		case action == "" && (r.Method == "GET" || r.Method == "HEAD"):
+			renderIndex(tmpl, w, r, collection)
+		case action == "" && r.Method == "POST":
+			name, expiry, err := parseCollectionForm(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			collectionTracker.Update(id, func(collection *Collection) {
+				collection.Name = name
+				collection.Expiry = expiry
+			})
+			notifyContentChange(room.Key())
+			http.Redirect(w, r, room.Path()+"/collections/"+id, http.StatusSeeOther)
+			log.Printf("Updated collection %s\n", id)
+		case action == "archive" && (r.Method == "GET" || r.Method == "HEAD"):
+			serveCollectionArchive(w, r, room, collection)
+		case action == "delete" && r.Method == "POST":
+			deleteCollection(w, r, room, collection)
+		case action == "" || action == "archive" || action == "delete":
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// Deletes a collection. Its entries are moved out of it, or deleted with
+// contents=true; pinned entries are kept unless confirm=pinned is also given
+func deleteCollection(w http.ResponseWriter, r *http.Request, room *Room, collection *Collection) {
+	deleteContents, _ := strconv.ParseBool(r.FormValue("contents"))
+	deleteContents = deleteContents || r.FormValue("contents") == "on"
+	var deleted, kept int
+	for _, entry := range filterEntriesByCollection(listEntries(room), collection.ID) {
+		if deleteContents && (!entry.Pinned || r.FormValue("confirm") == "pinned") {
+			send := sendTracker.Get(entry.ID)
+			if err := deleteEntry(entry.ID); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to delete %s: %v", entry.ID, err)
+				http.Error(w, "Failed to delete the collection's entries", http.StatusInternalServerError)
+				return
+			}
+			publishEntryRemoved(eventEntryDeleted, entry.ID, send)
+			deleted++
+			continue
+		}
+		setEntryCollection(entry.ID, "")
+		publishEntryEvent(eventEntryUpdated, entry.ID)
+		kept++
+	}
+	collectionTracker.Delete(collection.ID)
+	notifyContentChange(room.Key())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"deleted": deleted, "kept": kept})
+	log.Printf("Deleted collection %s (%d entries deleted, %d kept)\n", collection.ID, deleted, kept)
+}
+
+func setEntryCollection(id, collection string) {
+	if collection == "" && metadataTracker.Get(id) == nil {
+		return
+	}
+	metadataTracker.Update(id, func(meta *EntryMeta) { meta.Collection = collection })
+}
+
+// Streams a collection's snippets, files, and links as a zip file
+func serveCollectionArchive(w http.ResponseWriter, r *http.Request, room *Room, collection *Collection) {
+	entries := filterEntriesByCollection(visibleEntries(listEntries(room), deviceOwner(w, r)), collection.ID)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", collection.ID+".zip"))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == "HEAD" {
+		return
+	}
+	zw := zip.NewWriter(w)
+	var links []string
+	for _, entry := range entries {
+		header := &zip.FileHeader{Method: zip.Deflate, Modified: entry.Modified}
+		var err error
+		switch entry.Type {
+		case "link":
+			links = append(links, entry.Content)
+			continue
+		case "text":
+			header.Name = "snippets/" + entry.Filename
+			var out io.Writer
+			if out, err = zw.CreateHeader(header); err == nil {
+				_, err = io.WriteString(out, entry.Content)
+			}
+		case "file":
+			header.Name = "files/" + entry.Filename
+			err = writeArchiveFile(zw, header, entry.ID)
+		}
+		if err != nil {
+			// The response has started, so the best we can do is cut it short
+			log.Printf("Error archiving %s: %v", entry.ID, err)
+			return
+		}
+	}
+	if len(links) > 0 {
+		out, err := zw.CreateHeader(&zip.FileHeader{Name: "links.txt", Method: zip.Deflate, Modified: time.Now()})
+		if err == nil {
+			_, err = io.WriteString(out, strings.Join(links, "\n")+"\n")
+		}
+		if err != nil {
+			log.Printf("Error archiving links of %s: %v", collection.ID, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Error finishing archive of %s: %v", collection.ID, err)
+	}
+	log.Printf("Served archive of collection %s with %d entries\n", collection.ID, len(entries))
+}
+
+func writeArchiveFile(zw *zip.Writer, header *zip.FileHeader, id string) error {
+	f, err := os.Open(filepath.Join("data", id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader, err := decodedReader(f, metadataTracker.Get(id))
+	if err != nil {
+		return err
+	}
+	out, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, reader)
+	return err
+}
+
+// Moves an entry into the collection named by the "collection" form field,
+// or out of its collection when that is empty
+func handleMoveToCollection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := entryIDFromPath(r, "/move/")
+	if err != nil {
+		http.Error(w, "Invalid link", http.StatusBadRequest)
+		return
+	}
+	if !entryExists(id) {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	collection := r.FormValue("collection")
+	if collection != "" {
+		// Entries can only be moved into a collection of their own room
+		if c := collectionTracker.Get(collection); c == nil || c.Room != entryRoomKey(id) {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return
+		}
+	}
+	setEntryCollection(id, collection)
+	publishEntryEvent(eventEntryUpdated, id)
+	notifyContentChange(entryRoomKey(id))
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"collection": collection})
+	} else {
+		http.Redirect(w, r, roomPath(entryRoomKey(id))+"/", http.StatusSeeOther)
+	}
+	log.Printf("Moved %s to collection %q\n", id, collection)
+}
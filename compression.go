@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Snippets, the notepad and text-like uploads are stored gzip-compressed when
+// COMPRESS_STORAGE=true. Compressed entries are marked in their metadata, passed
+// through with Content-Encoding: gzip to clients that accept it, and
+// decompressed on the fly for everyone else
+var compressStorage = false
+
+const compressMinSize = 1 << 10 // smaller bodies aren't worth compressing
+
+func initCompression() {
+	switch strings.ToLower(os.Getenv("COMPRESS_STORAGE")) {
+	case "true", "1", "yes", "gzip":
+		compressStorage = true
+		log.Println("Compression of stored snippets and text files enabled.")
+	}
+}
+
+// Reports whether a content type is text-like enough to be worth compressing
+func isCompressibleType(ctype string) bool {
+	mediaType, _, _ := mime.ParseMediaType(ctype)
+	switch mediaType {
+	case "application/json", "application/yaml", "application/toml", "application/xml", "application/rtf",
+		"application/javascript", "application/x-ndjson", "application/sql":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+xml") ||
+		strings.HasSuffix(mediaType, "+json")
+}
+
+// Compression has to save at least a tenth of the size to be kept
+func worthCompressing(original, compressed int64) bool {
+	return original >= compressMinSize && compressed <= original-original/10
+}
+
+// Returns a snippet or notepad body as it would be stored, compressed when
+// worthwhile, with its encoding
+func encodeEntryContent(content []byte) ([]byte, string) {
+	if compressStorage && len(content) >= compressMinSize {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(content)
+		if err := zw.Close(); err == nil && worthCompressing(int64(len(content)), int64(buf.Len())) {
+			return buf.Bytes(), "gzip"
+		}
+	}
+	return content, ""
+}
+
+// Writes a snippet or notepad body, compressing it when worthwhile, and returns
+// the number of bytes stored on disk
+func writeEntryContent(id string, content []byte) (int64, error) {
+	data, encoding := encodeEntryContent(content)
+	if err := os.WriteFile(filepath.Join("data", id), data, 0644); err != nil {
+		return 0, err
+	}
+	if encoding != "" || metadataTracker.Get(id) != nil {
+		metadataTracker.Update(id, func(meta *EntryMeta) {
+			meta.Encoding = encoding
+			meta.Length = 0
+			if encoding != "" {
+				meta.Length = int64(len(content))
+			}
+		})
+	}
+	return int64(len(data)), nil
+}
+
+// Reads a snippet or notepad body, decompressing it if needed
+func readEntryContent(id string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join("data", id))
+	if err != nil {
+		return nil, err
+	}
+	if meta := metadataTracker.Get(id); meta != nil && meta.Encoding == "gzip" {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(zr)
+	}
+	return data, nil
+}
+
+// Compresses an uploaded temporary file in place if it is text-like and
+// compression pays off, returning the encoding applied ("" if none)
+func compressUpload(path, name string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() < compressMinSize {
+		return "", err
+	}
+	ctype, err := detectContentType(name, f)
+	if err != nil || !isCompressibleType(ctype) {
+		return "", err
+	}
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return "", err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, f)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	compressed, err := os.Stat(out.Name())
+	if err != nil || !worthCompressing(info.Size(), compressed.Size()) {
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := os.Rename(out.Name(), path); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return "gzip", nil
+}
+
+// Returns a reader for an entry's decoded content
+func decodedReader(f *os.File, meta *EntryMeta) (io.Reader, error) {
+	if meta != nil && meta.Encoding == "gzip" {
+		return gzip.NewReader(f)
+	}
+	return f, nil
+}
+
+// Like detectContentType, but sniffs the decoded content of compressed entries
+func detectEntryContentType(id string, f *os.File, meta *EntryMeta) (string, error) {
+	if meta == nil || meta.Encoding == "" {
+		return detectContentType(id, f)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	header := make([]byte, 512)
+	n, err := io.ReadFull(zr, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return detectContentType(id, bytes.NewReader(header[:n]))
+}
+
+func acceptsGzip(r *http.Request) bool {
+	return acceptsEncoding(r, "gzip")
+}
+
+// Reports whether the client's Accept-Encoding allows the given content coding
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != encoding && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Serves a compressed entry whose Content-Type and Content-Disposition are
+// already set. Clients accepting gzip get the stored stream as is (with range
+// support); others get it decompressed, in full
+func serveCompressedEntry(w http.ResponseWriter, r *http.Request, f *os.File, info os.FileInfo, meta *EntryMeta) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		// Digests describe the decoded content, not the gzip stream
+		w.Header().Del("Repr-Digest")
+		w.Header().Del("Digest")
+		w.Header().Set("Content-Encoding", "gzip")
+		http.ServeContent(w, r, "", info.ModTime(), f)
+		return
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		http.Error(w, "Could not decompress file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	if meta.Length > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(meta.Length, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+	if _, err := io.Copy(w, zr); err != nil {
+		log.Printf("Error decompressing %s: %v", f.Name(), err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Saves of the notepad and of snippets can be made conditional so edits based
+// on content that has changed since are not lost. GET /notepad/ and /raw/
+// return the content's ETag; a POST to /notepad/ or /edit/ whose If-Match
+// header doesn't match the content any more is refused with 412 and the
+// current content, so the client can merge or overwrite
+
+// Keeps a snippet from changing between checking If-Match and saving
+var snippetEditMu sync.Mutex
+
+// Quoted ETag for some content, a hash of it
+func contentETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// ETag for content sent with a Content-Encoding, so caches never mix it up
+// with the identity response, as done for static assets
+func encodedETag(etag, encoding string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// Reports whether an If-Match header allows changing content with the given
+// ETag, or its gzip variant. No header allows anything, and "*" anything that
+// exists
+func ifMatchAllows(ifMatch, etag string, exists bool) bool {
+	if ifMatch == "" {
+		return true
+	}
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if exists && (tag == "*" || tag == etag || tag == encodedETag(etag, "gzip")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refuses a conditional save, sending back the content it would have replaced
+func writePreconditionFailed(w http.ResponseWriter, content []byte) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("ETag", contentETag(content))
+	w.WriteHeader(http.StatusPreconditionFailed)
+	w.Write(content)
+}
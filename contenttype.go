@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Content types by extension, checked before sniffing the file itself
+var contentTypesByExt = map[string]string{
+	// Text and code
+	".txt": "text/plain", ".log": "text/plain", ".md": "text/markdown", ".csv": "text/csv",
+	".tsv": "text/tab-separated-values", ".json": "application/json", ".yaml": "application/yaml",
+	".yml": "application/yaml", ".toml": "application/toml", ".ini": "text/plain", ".conf": "text/plain",
+	".go": "text/plain", ".py": "text/plain", ".rs": "text/plain", ".sh": "text/plain", ".c": "text/plain",
+	".h": "text/plain", ".cpp": "text/plain", ".java": "text/plain", ".ts": "text/plain", ".sql": "text/plain",
+	".css": "text/css", ".rtf": "application/rtf",
+	// Active content that must never render on our origin
+	".html": "text/html", ".htm": "text/html", ".xhtml": "application/xhtml+xml", ".xml": "application/xml",
+	".svg": "image/svg+xml", ".js": "text/javascript", ".mjs": "text/javascript", ".xsl": "application/xml",
+	// Images
+	".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".png": "image/png", ".gif": "image/gif", ".webp": "image/webp",
+	".bmp": "image/bmp", ".ico": "image/x-icon", ".avif": "image/avif", ".heic": "image/heic", ".heif": "image/heif",
+	".tif": "image/tiff", ".tiff": "image/tiff",
+	// Audio and video
+	".mp3": "audio/mpeg", ".wav": "audio/wav", ".ogg": "audio/ogg", ".oga": "audio/ogg", ".opus": "audio/ogg",
+	".flac": "audio/flac", ".m4a": "audio/mp4", ".aac": "audio/aac", ".mp4": "video/mp4", ".m4v": "video/mp4",
+	".webm": "video/webm", ".mov": "video/quicktime", ".mkv": "video/x-matroska", ".avi": "video/x-msvideo",
+	// Documents
+	".pdf": "application/pdf", ".epub": "application/epub+zip", ".doc": "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text", ".ods": "application/vnd.oasis.opendocument.spreadsheet",
+	// Archives and binaries
+	".zip": "application/zip", ".tar": "application/x-tar", ".gz": "application/gzip", ".tgz": "application/gzip",
+	".bz2": "application/x-bzip2", ".xz": "application/x-xz", ".7z": "application/x-7z-compressed",
+	".zst": "application/zstd", ".rar": "application/vnd.rar", ".iso": "application/x-iso9660-image",
+	".apk": "application/vnd.android.package-archive", ".wasm": "application/wasm",
+}
+
+// Magic numbers for formats http.DetectContentType doesn't know about
+var contentTypesByMagic = []struct {
+	offset int
+	magic  []byte
+	ctype  string
+}{
+	{0, []byte("7z\xBC\xAF\x27\x1C"), "application/x-7z-compressed"},
+	{0, []byte("\xFD7zXZ\x00"), "application/x-xz"},
+	{0, []byte("BZh"), "application/x-bzip2"},
+	{0, []byte("\x28\xB5\x2F\xFD"), "application/zstd"},
+	{0, []byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+	{257, []byte("ustar"), "application/x-tar"},
+	{4, []byte("ftypheic"), "image/heic"},
+	{4, []byte("ftypheix"), "image/heic"},
+	{4, []byte("ftypmif1"), "image/heif"},
+	{4, []byte("ftypavif"), "image/avif"},
+	{4, []byte("ftypqt"), "video/quicktime"},
+}
+
+// Dangerous types are sandboxed on /view/ by default; VIEW_ACTIVE_CONTENT=download
+// forces them to download instead
+var forceDownloadActiveContent = false
+
+func initContentTypes() {
+	if strings.ToLower(os.Getenv("VIEW_ACTIVE_CONTENT")) == "download" {
+		forceDownloadActiveContent = true
+		log.Println("HTML, SVG, XML, and JavaScript files will be downloaded instead of viewed.")
+	}
+}
+
+// Determines a file's content type from its extension, falling back to magic bytes
+func detectContentType(name string, f io.ReadSeeker) (string, error) {
+	ctype, ok := contentTypesByExt[strings.ToLower(filepath.Ext(name))]
+	if !ok {
+		header := make([]byte, 512)
+		n, err := io.ReadFull(f, header)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		ctype = sniffContentType(header[:n])
+	}
+	if strings.HasPrefix(ctype, "text/") && !strings.Contains(ctype, "charset") {
+		ctype += "; charset=utf-8"
+	}
+	return ctype, nil
+}
+
+// Content type from the extension alone, for streams that can't be sniffed
+func contentTypeByName(name string) string {
+	if ctype, ok := contentTypesByExt[strings.ToLower(filepath.Ext(name))]; ok {
+		return ctype
+	}
+	return "application/octet-stream"
+}
+
+func sniffContentType(header []byte) string {
+	for _, m := range contentTypesByMagic {
+		if len(header) >= m.offset+len(m.magic) && bytes.Equal(header[m.offset:m.offset+len(m.magic)], m.magic) {
+			return m.ctype
+		}
+	}
+	return http.DetectContentType(header)
+}
+
+// Reports whether a content type can run script or load resources when
+// rendered by the browser
+func isActiveContentType(ctype string) bool {
+	mediaType, _, _ := mime.ParseMediaType(ctype)
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml",
+		"text/javascript", "application/javascript", "application/x-javascript", "application/ecmascript",
+		"text/xsl", "application/xslt+xml":
+		return true
+	}
+	return strings.HasSuffix(mediaType, "+xml")
+}
+
+// Builds a Content-Disposition header that survives quotes and non-ASCII names
+func contentDisposition(disposition, filename string) string {
+	if v := mime.FormatMediaType(disposition, map[string]string{"filename": filename}); v != "" {
+		return v
+	}
+	return disposition
+}
+
+// Serves an entry file for inline viewing, neutralising active content
+func serveFileInline(w http.ResponseWriter, r *http.Request, id string) {
+	path := filepath.Join("data", id)
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	meta := metadataTracker.Get(id)
+	ctype, err := detectEntryContentType(id, file, meta)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	disposition := "inline"
+	if isActiveContentType(ctype) {
+		if forceDownloadActiveContent {
+			disposition = "attachment"
+		} else {
+			// An opaque-origin sandbox with no script or network access, so the file
+			// renders but cannot act on the rest of the app
+			w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; img-src data:; style-src 'unsafe-inline'; media-src data:")
+		}
+		// Scripts display as source rather than being offered as a download
+		if mediaType, _, _ := mime.ParseMediaType(ctype); strings.Contains(mediaType, "javascript") {
+			ctype = "text/plain; charset=utf-8"
+		}
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, filepath.Base(id)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if meta != nil && meta.Encoding != "" {
+		serveCompressedEntry(w, r, file, info, meta)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
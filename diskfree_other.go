@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+// Free space is unknown here, so the MIN_FREE_SPACE reserve is not enforced
+func diskFree(path string) int64 {
+	return -1
+}
+
+func isDiskFullError(err error) bool {
+	return false
+}
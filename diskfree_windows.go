@@ -0,0 +1,30 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// Returns the bytes available to the current user on the volume holding path
+func diskFree(path string) int64 {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return -1
+	}
+	var freeBytes uint64
+	ret, _, _ := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&freeBytes)), 0, 0)
+	if ret == 0 {
+		return -1
+	}
+	return int64(freeBytes)
+}
+
+func isDiskFullError(err error) bool {
+	const errorHandleDiskFull, errorDiskFull = syscall.Errno(39), syscall.Errno(112)
+	return errors.Is(err, errorHandleDiskFull) || errors.Is(err, errorDiskFull)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Named SSE events describing what changed, sent alongside the plain
+// "content_updated" message that older clients reload on
+const (
+	eventEntryCreated   = "entry.created"
+	eventEntryUpdated   = "entry.updated"
+	eventEntryDeleted   = "entry.deleted"
+	eventEntryExpired   = "entry.expired"
+	eventNotepadCreated = "notepad.created"
+	eventNotepadUpdated = "notepad.updated"
+	eventNotepadDeleted = "notepad.deleted"
+	eventNotepadExpired = "notepad.expired"
+)
+
+// Sent instead of a replay when a client's Last-Event-ID is older than the
+// history kept, so it should reload everything
+const eventResyncRequired = "resync.required"
+
+// The most recent messages are kept, up to a count and a total size, for
+// clients that reconnect with Last-Event-ID
+const (
+	eventHistorySize  = 1000
+	eventHistoryBytes = 8 << 20
+)
+
+// A message for SSE clients; Event is empty for unnamed messages. Messages
+// with a Device only go to that device's subscribers
+type sseMessage struct {
+	ID     uint64 `json:"id"`
+	Room   string `json:"room,omitempty"`
+	Device string `json:"device,omitempty"`
+	Event  string `json:"event,omitempty"`
+	Data   string `json:"data"`
+}
+
+// Recent messages across all rooms, saved to data/events.json so IDs keep
+// increasing and replays work across restarts. Of the events about entries,
+// notepads and sends only the IDs are kept; their payloads are built afresh
+// when they're replayed, so no contents are written out
+type EventHistory struct {
+	LastID uint64       `json:"lastId"`
+	Events []sseMessage `json:"events"`
+	size   int
+	dirty  chan struct{}
+	mu     sync.Mutex // mutex for thread safety
+}
+
+func initEventHistory() *EventHistory {
+	history := &EventHistory{dirty: make(chan struct{}, 1)}
+	historyFile := filepath.Join("data", "events.json")
+	if data, err := os.ReadFile(historyFile); err == nil {
+		if err := json.Unmarshal(data, history); err != nil {
+			log.Printf("Error loading event history, starting afresh: %v", err)
+			history.Events = nil
+		}
+	}
+	for i, msg := range history.Events {
+		history.Events[i] = historyMessage(msg)
+		history.size += len(history.Events[i].Data)
+	}
+	go history.saveLoop()
+	return history
+}
+
+// Numbers a message and adds it to the history, dropping the oldest ones
+// once it's full
+func (h *EventHistory) append(msg sseMessage) sseMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.LastID++
+	msg.ID = h.LastID
+	stored := historyMessage(msg)
+	h.Events = append(h.Events, stored)
+	h.size += len(stored.Data)
+	for len(h.Events) > eventHistorySize || (h.size > eventHistoryBytes && len(h.Events) > 1) {
+		h.size -= len(h.Events[0].Data)
+		h.Events = h.Events[1:]
+	}
+	select {
+	case h.dirty <- struct{}{}:
+	default:
+	}
+	return msg
+}
+
+// Returns a room's messages for a device after lastID, or false if some of
+// them are no longer kept (or lastID is not one this server handed out)
+func (h *EventHistory) since(room, device string, lastID uint64) ([]sseMessage, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if lastID > h.LastID {
+		return nil, false
+	}
+	if lastID == h.LastID {
+		return nil, true
+	}
+	if len(h.Events) == 0 || h.Events[0].ID > lastID+1 {
+		return nil, false
+	}
+	var missed []sseMessage
+	for _, msg := range h.Events[lastID+1-h.Events[0].ID:] {
+		if msg.Room == room && (msg.Device == "" || msg.Device == device) {
+			missed = append(missed, msg)
+		}
+	}
+	return missed, true
+}
+
+// What the history keeps of an event about an entry, notepad or send
+type eventRef struct {
+	ID         string `json:"id"`
+	PreviousID string `json:"previousId,omitempty"`
+}
+
+// The events whose payloads are rebuilt from an eventRef on replay
+var replayedEvents = map[string]bool{
+	eventEntryCreated: true, eventEntryUpdated: true, eventEntryDeleted: true, eventEntryExpired: true,
+	eventNotepadCreated: true, eventNotepadUpdated: true, eventNotepadDeleted: true, eventNotepadExpired: true,
+	eventSendOffered: true, eventSendAccepted: true, eventSendDeclined: true,
+}
+
+// A message as the history keeps it, reduced to an eventRef if it's one of
+// the replayedEvents
+func historyMessage(msg sseMessage) sseMessage {
+	var ref eventRef
+	if !replayedEvents[msg.Event] || json.Unmarshal([]byte(msg.Data), &ref) != nil || ref.ID == "" {
+		return msg
+	}
+	data, _ := json.Marshal(ref)
+	msg.Data = string(data)
+	return msg
+}
+
+// Builds the payloads of replayed messages from the entries as they are now.
+// An entry sent to one device is only included for that device
+func replayMessages(msgs []sseMessage, device string) []sseMessage {
+	listings := map[string][]Entry{}
+	find := func(id string) *Entry {
+		key := entryRoomKey(id)
+		if _, ok := listings[key]; !ok {
+			room, ok := entryRoom(id)
+			if !ok {
+				return nil
+			}
+			listings[key] = listEntries(room)
+		}
+		for _, entry := range listings[key] {
+			if entry.ID == id {
+				return &entry
+			}
+		}
+		return nil
+	}
+	replayed := make([]sseMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		var ref eventRef
+		if !replayedEvents[msg.Event] || json.Unmarshal([]byte(msg.Data), &ref) != nil || ref.ID == "" {
+			replayed = append(replayed, msg)
+			continue
+		}
+		send := sendTracker.Get(ref.ID)
+		var payload any
+		switch msg.Event {
+		case eventEntryCreated, eventEntryUpdated, eventEntryDeleted, eventEntryExpired:
+			event := EntryEvent{ID: ref.ID, PreviousID: ref.PreviousID, Room: entryRoomKey(ref.ID)}
+			if (msg.Event == eventEntryCreated || msg.Event == eventEntryUpdated) && (send == nil || send.Recipient == device) {
+				event.Entry = find(ref.ID)
+			}
+			payload = event
+		case eventNotepadCreated, eventNotepadUpdated, eventNotepadDeleted, eventNotepadExpired:
+			payload = notepadEventPayload(ref.ID, ref.PreviousID)
+		case eventSendOffered:
+			event := SendEvent{ID: ref.ID, Room: entryRoomKey(ref.ID)}
+			if send != nil && send.Recipient == device {
+				event = sendOfferPayload(ref.ID, send)
+				event.Entry = find(ref.ID)
+			}
+			payload = event
+		case eventSendAccepted, eventSendDeclined:
+			event := SendEvent{ID: ref.ID, Room: entryRoomKey(ref.ID), Accepted: msg.Event == eventSendAccepted}
+			if send != nil {
+				event.To = deviceTracker.Name(send.Recipient)
+			}
+			payload = event
+		}
+		data, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Error marshaling replayed %s event: %v", msg.Event, err)
+			continue
+		}
+		msg.Data = string(data)
+		replayed = append(replayed, msg)
+	}
+	return replayed
+}
+
+// Writes the history at most once a second while it's changing
+func (h *EventHistory) saveLoop() {
+	for range h.dirty {
+		time.Sleep(time.Second)
+		h.mu.Lock()
+		data, err := json.Marshal(h)
+		h.mu.Unlock()
+		if err != nil {
+			log.Printf("Error marshaling event history: %v", err)
+			continue
+		}
+		if err := os.WriteFile(filepath.Join("data", "events.json"), data, 0600); err != nil {
+			log.Printf("Error saving event history: %v", err)
+		}
+	}
+}
+
+// The ID of the latest message, for pages to resume their updates from
+func (h *EventHistory) lastID() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.LastID
+}
+
+// Writes a message; those without an ID, like presence, leave the client's
+// last event ID as it is
+func writeSSE(w http.ResponseWriter, msg sseMessage) {
+	if msg.ID != 0 {
+		fmt.Fprintf(w, "id: %d\n", msg.ID)
+	}
+	if msg.Event != "" {
+		fmt.Fprintf(w, "event: %s\n", msg.Event)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", msg.Data)
+}
+
+// Payload of the entry.* events
+type EntryEvent struct {
+	ID         string `json:"id"`
+	PreviousID string `json:"previousId,omitempty"` // set when the entry was renamed
+	Room       string `json:"room,omitempty"`
+	Entry      *Entry `json:"entry,omitempty"` // absent once the entry is gone
+}
+
+// Payload of the notepad.* events; once it's gone, Modified is when it went
+type NotepadEvent struct {
+	ID         string    `json:"id"`
+	PreviousID string    `json:"previousId,omitempty"` // set when the notepad was renamed
+	Room       string    `json:"room,omitempty"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	Modified   time.Time `json:"modified"`
+}
+
+// Looks up an entry as it would be listed
+func findEntry(id string) (*Entry, bool) {
+	room, ok := entryRoom(id)
+	if !ok {
+		return nil, false
+	}
+	for _, entry := range listEntries(room) {
+		if entry.ID == id {
+			return &entry, true
+		}
+	}
+	return nil, false
+}
+
+// Tells the members of an entry's room what happened to it, or only its
+// recipient if it was sent to one device. Created and updated entries are
+// sent in full
+func publishEntryEvent(event, id string) {
+	payload := EntryEvent{ID: id, Room: entryRoomKey(id)}
+	if event == eventEntryCreated || event == eventEntryUpdated {
+		payload.Entry, _ = findEntry(id)
+	}
+	recipient := ""
+	if send := sendTracker.Get(id); send != nil {
+		recipient = send.Recipient
+	}
+	publishEvent(payload.Room, recipient, event, payload)
+}
+
+// Publishes entry.deleted or entry.expired. Removing an entry forgets its
+// send, so send is what sendTracker.Get returned for it beforehand
+func publishEntryRemoved(event, id string, send *Send) {
+	recipient := ""
+	if send != nil {
+		recipient = send.Recipient
+	}
+	publishEvent(entryRoomKey(id), recipient, event, EntryEvent{ID: id, Room: entryRoomKey(id)})
+}
+
+func publishEntryRenamed(oldID, newID string) {
+	payload := EntryEvent{ID: newID, PreviousID: oldID, Room: entryRoomKey(newID)}
+	payload.Entry, _ = findEntry(newID)
+	recipient := ""
+	if send := sendTracker.Get(newID); send != nil {
+		recipient = send.Recipient
+	}
+	publishEvent(payload.Room, recipient, eventEntryUpdated, payload)
+}
+
+func publishNotepadEvent(event, id, previousID string) {
+	publishEvent(entryRoomKey(id), "", event, notepadEventPayload(id, previousID))
+}
+
+func notepadEventPayload(id, previousID string) NotepadEvent {
+	name, _ := notepadNameFromID(id)
+	payload := NotepadEvent{ID: id, PreviousID: previousID, Room: entryRoomKey(id), Name: name, Modified: time.Now()}
+	if info, err := os.Stat(filepath.Join("data", id)); err == nil {
+		payload.Size, payload.Modified = info.Size(), info.ModTime()
+	}
+	return payload
+}
+
+// Publishes an event to one device's subscribers in a room, or to all of
+// them when device is empty
+func publishEvent(room, device, event string, payload any) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling %s event: %v", event, err)
+		return
+	}
+	hub.Publish(room, sseMessage{Device: device, Event: event, Data: string(data)})
+}
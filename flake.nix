@@ -31,7 +31,7 @@
             pname = "local-content-share";
             version = ""; # nix needs version to be set, though setting it to the right one would mean it needs to be updated at each release
             src = ./.;
-            vendorHash = null;
+            vendorHash = "sha256-9Qvfcy8Uxq1oAIqpnk49I4iZBZw4TuoUtbGXoWkmZdg=";
 
             meta = {
               mainProgram = "local-content-share";
@@ -1,3 +1,11 @@
 module github.com/tanq16/local-content-share
 
 go 1.23.2
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	golang.org/x/image v0.23.0
+	lukechampine.com/blake3 v1.3.0
+)
+
+require github.com/klauspost/cpuid/v2 v2.0.9 // indirect
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Each subscriber gets a buffered queue. Publishing never waits for one: a
+// subscriber whose queue is full is evicted, which ends its stream, and its
+// client catches up from the event history when it reconnects
+const subscriberQueueSize = 256
+
+type subscriber struct {
+	room    string
+	device  string // owner ID from the device cookie
+	name    string // the device's display name
+	queue   chan sseMessage
+	evicted chan struct{} // closed when the subscriber fell too far behind
+	removed bool
+}
+
+// Fans messages out to the SSE subscribers of each room, by room slug ("" for
+// the default room)
+type Hub struct {
+	rooms    map[string]map[*subscriber]bool
+	presence map[string]map[string]*Presence // by room, then device
+	history  *EventHistory
+	mu       sync.Mutex // also orders publishing against catching up
+}
+
+var hub *Hub
+
+func newHub(history *EventHistory) *Hub {
+	return &Hub{
+		rooms:    make(map[string]map[*subscriber]bool),
+		presence: make(map[string]map[string]*Presence),
+		history:  history,
+	}
+}
+
+// Registers a device's subscriber for a room. The messages to send before
+// anything from its queue are returned along with it: those missed since
+// lastEventID (or resync.required if they are gone), the initial "connected"
+// message, and the room's presence
+func (h *Hub) Subscribe(room, lastEventID, device, name string) (*subscriber, []sseMessage) {
+	sub, catchUp := h.subscribe(room, lastEventID, device, name)
+	// Payloads are read back outside the lock, as that lists the entries
+	return sub, replayMessages(catchUp, device)
+}
+
+func (h *Hub) subscribe(room, lastEventID, device, name string) (*subscriber, []sseMessage) {
+	sub := &subscriber{
+		room:    room,
+		device:  device,
+		name:    name,
+		queue:   make(chan sseMessage, subscriberQueueSize),
+		evicted: make(chan struct{}),
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	currentID := h.history.lastID()
+	var catchUp []sseMessage
+	if lastEventID != "" {
+		lastID, err := strconv.ParseUint(lastEventID, 10, 64)
+		ok := err == nil
+		if ok {
+			catchUp, ok = h.history.since(room, device, lastID)
+		}
+		if !ok {
+			catchUp = append(catchUp, sseMessage{ID: currentID, Event: eventResyncRequired, Data: fmt.Sprintf(`{"lastEventId":%d}`, currentID)})
+		}
+	}
+	catchUp = append(catchUp, sseMessage{ID: currentID, Data: "connected"})
+	// The others hear about the device before the subscriber is added
+	if h.joinLocked(sub) {
+		h.sendLocked(room, h.presenceMessageLocked(room))
+	}
+	catchUp = append(catchUp, h.presenceMessageLocked(room))
+	if h.rooms[room] == nil {
+		h.rooms[room] = make(map[*subscriber]bool)
+	}
+	h.rooms[room][sub] = true
+	return sub, catchUp
+}
+
+func (h *Hub) Unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.remove(sub) {
+		h.sendLocked(sub.room, h.presenceMessageLocked(sub.room))
+	}
+}
+
+// Removes a subscriber once, reporting whether its device went offline
+func (h *Hub) remove(sub *subscriber) bool {
+	if sub.removed {
+		return false
+	}
+	sub.removed = true
+	delete(h.rooms[sub.room], sub)
+	if len(h.rooms[sub.room]) == 0 {
+		delete(h.rooms, sub.room)
+	}
+	return h.leaveLocked(sub)
+}
+
+// Numbers a message, records it in the history, and queues it for the room's
+// subscribers
+func (h *Hub) Publish(room string, msg sseMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	msg.Room = room
+	msg = h.history.append(msg)
+	h.sendLocked(room, msg)
+}
+
+// Queues a message for a room's subscribers without numbering or recording
+// it, for updates only of use as they happen
+func (h *Hub) Broadcast(room string, msg sseMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	msg.Room = room
+	h.sendLocked(room, msg)
+}
+
+// Queues a message for a room's subscribers (or those of msg.Device), evicting
+// those that are full. Called with h.mu held
+func (h *Hub) sendLocked(room string, msg sseMessage) {
+	left := false
+	for sub := range h.rooms[room] {
+		if msg.Device != "" && msg.Device != sub.device {
+			continue
+		}
+		select {
+		case sub.queue <- msg:
+		default:
+			left = h.remove(sub) || left
+			close(sub.evicted)
+		}
+	}
+	if left {
+		h.sendLocked(room, h.presenceMessageLocked(room))
+	}
+}
+
+// Number of subscribers in a room
+func (h *Hub) Subscribers(room string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.rooms[room])
+}
+
+// Total number of subscribers across all rooms
+func (h *Hub) TotalSubscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	total := 0
+	for _, subs := range h.rooms {
+		total += len(subs)
+	}
+	return total
+}
+
+// Takes whatever else is queued after msg, so a burst is written at once.
+// Of repeated unnamed messages like content_updated only the last is kept
+func (sub *subscriber) drain(msg sseMessage) []sseMessage {
+	batch := []sseMessage{msg}
+	for len(batch) < subscriberQueueSize {
+		select {
+		case msg := <-sub.queue:
+			batch = append(batch, msg)
+			continue
+		default:
+		}
+		break
+	}
+	seen := map[string]bool{}
+	coalesced := make([]sseMessage, 0, len(batch))
+	for i := len(batch) - 1; i >= 0; i-- {
+		if batch[i].Event == "" {
+			if seen[batch[i].Data] {
+				continue
+			}
+			seen[batch[i].Data] = true
+		}
+		coalesced = append(coalesced, batch[i])
+	}
+	for i, j := 0, len(coalesced)-1; i < j; i, j = i+1, j-1 {
+		coalesced[i], coalesced[j] = coalesced[j], coalesced[i]
+	}
+	return coalesced
+}
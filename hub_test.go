@@ -0,0 +1,375 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// A hub whose history is never saved to disk
+func newTestHub() *Hub {
+	return newHub(&EventHistory{dirty: make(chan struct{}, 1)})
+}
+
+// Takes everything queued for a subscriber without waiting
+func queued(sub *subscriber) []sseMessage {
+	var msgs []sseMessage
+	for {
+		select {
+		case msg := <-sub.queue:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+func isEvicted(sub *subscriber) bool {
+	select {
+	case <-sub.evicted:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestHubPublishFanOut(t *testing.T) {
+	const subscribers, publishers, perPublisher = 2000, 8, 25
+	h := newTestHub()
+	subs := make([]*subscriber, subscribers)
+	var wg sync.WaitGroup
+	for i := range subs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// One device throughout, so joining sends no presence updates
+			subs[i], _ = h.Subscribe("a", "", "device", "Device")
+		}()
+	}
+	other, _ := h.Subscribe("b", "", "device", "Device")
+	wg.Wait()
+	if got := h.Subscribers("a"); got != subscribers {
+		t.Fatalf("Subscribers(a) = %d, want %d", got, subscribers)
+	}
+
+	received := make([][]sseMessage, subscribers)
+	done := make(chan struct{})
+	for i, sub := range subs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for len(received[i]) < publishers*perPublisher {
+				select {
+				case msg := <-sub.queue:
+					received[i] = append(received[i], sub.drain(msg)...)
+				case <-sub.evicted:
+					t.Errorf("subscriber %d was evicted", i)
+					return
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	var publishing sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		publishing.Add(1)
+		go func() {
+			defer publishing.Done()
+			for n := 0; n < perPublisher; n++ {
+				h.Publish("a", sseMessage{Event: eventEntryCreated, Data: fmt.Sprintf("%d-%d", p, n)})
+			}
+		}()
+	}
+	publishing.Wait()
+	wg.Wait()
+	close(done)
+
+	for i, msgs := range received {
+		if len(msgs) != publishers*perPublisher {
+			t.Fatalf("subscriber %d got %d messages, want %d", i, len(msgs), publishers*perPublisher)
+		}
+		for j, msg := range msgs {
+			if msg.ID != uint64(j+1) || msg.Room != "a" {
+				t.Fatalf("subscriber %d message %d = %+v, want ID %d in room a", i, j, msg, j+1)
+			}
+		}
+	}
+	if msgs := queued(other); len(msgs) != 0 {
+		t.Errorf("subscriber of another room got %d messages", len(msgs))
+	}
+}
+
+func TestHubPublishToDevice(t *testing.T) {
+	h := newTestHub()
+	phone, _ := h.Subscribe("", "", "phone", "Phone")
+	laptop, _ := h.Subscribe("", "", "laptop", "Laptop")
+	queued(phone) // the laptop's arrival
+
+	h.Publish("", sseMessage{Device: "laptop", Event: eventEntryCreated, Data: "for the laptop"})
+	if msgs := queued(phone); len(msgs) != 0 {
+		t.Errorf("phone got %+v", msgs)
+	}
+	if msgs := queued(laptop); len(msgs) != 1 || msgs[0].Data != "for the laptop" {
+		t.Errorf("laptop got %+v", msgs)
+	}
+}
+
+func TestHubEvictsSlowSubscribers(t *testing.T) {
+	const subscribers = 2000
+	h := newTestHub()
+	subs := make([]*subscriber, subscribers)
+	for i := range subs {
+		subs[i], _ = h.Subscribe("", "", "device", "Device")
+	}
+	// A full queue's worth fits everyone; then the odd ones catch up
+	for n := 0; n < subscriberQueueSize; n++ {
+		h.Publish("", sseMessage{Event: eventEntryCreated, Data: strconv.Itoa(n)})
+	}
+	var wg sync.WaitGroup
+	for i := 1; i < subscribers; i += 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if msgs := queued(subs[i]); len(msgs) != subscriberQueueSize {
+				t.Errorf("subscriber %d had %d messages queued, want %d", i, len(msgs), subscriberQueueSize)
+			}
+		}()
+	}
+	wg.Wait()
+
+	h.Publish("", sseMessage{Event: eventEntryCreated, Data: "one too many"})
+	for i, sub := range subs {
+		if slow := i%2 == 0; isEvicted(sub) != slow {
+			t.Fatalf("subscriber %d evicted = %v, want %v", i, isEvicted(sub), slow)
+		}
+	}
+	if got := h.Subscribers(""); got != subscribers/2 {
+		t.Errorf("Subscribers() = %d after evictions, want %d", got, subscribers/2)
+	}
+	if msgs := queued(subs[1]); len(msgs) != 1 || msgs[0].Data != "one too many" {
+		t.Errorf("subscriber that kept up got %+v", msgs)
+	}
+
+	// The stream handler unsubscribes evicted subscribers too
+	for _, sub := range subs {
+		h.Unsubscribe(sub)
+	}
+	if got := h.TotalSubscribers(); got != 0 {
+		t.Errorf("TotalSubscribers() = %d after unsubscribing, want 0", got)
+	}
+}
+
+func TestHubEvictionUpdatesPresence(t *testing.T) {
+	h := newTestHub()
+	slow, _ := h.Subscribe("", "", "slow", "Slow")
+	fast, _ := h.Subscribe("", "", "fast", "Fast")
+	// The slow one's queue already holds the fast one's arrival
+	for n := 0; n < subscriberQueueSize-1; n++ {
+		queued(fast)
+		h.Publish("", sseMessage{Data: "content_updated"})
+	}
+	queued(fast)
+	h.Publish("", sseMessage{Data: "content_updated"})
+	if !isEvicted(slow) {
+		t.Fatal("slow subscriber was not evicted")
+	}
+	msgs := queued(fast)
+	if len(msgs) != 2 || msgs[1].Event != eventPresenceUpdated {
+		t.Fatalf("fast subscriber got %+v, want the message and a presence update", msgs)
+	}
+	if list := h.Presence(""); list.Online != 1 {
+		t.Errorf("%d devices online after eviction, want 1", list.Online)
+	}
+}
+
+func TestSubscriberDrainCoalesces(t *testing.T) {
+	sub := &subscriber{queue: make(chan sseMessage, subscriberQueueSize)}
+	for _, msg := range []sseMessage{
+		{ID: 2, Event: eventEntryCreated, Data: "x"},
+		{ID: 3, Data: "content_updated"},
+		{ID: 4, Event: eventEntryCreated, Data: "x"},
+		{ID: 5, Data: "content_updated"},
+	} {
+		sub.queue <- msg
+	}
+	got := sub.drain(sseMessage{ID: 1, Data: "content_updated"})
+	want := []uint64{2, 4, 5}
+	if len(got) != len(want) {
+		t.Fatalf("drain returned %+v, want IDs %v", got, want)
+	}
+	for i, msg := range got {
+		if msg.ID != want[i] {
+			t.Fatalf("drain returned %+v, want IDs %v", got, want)
+		}
+	}
+	if len(sub.queue) != 0 {
+		t.Errorf("%d messages left in the queue", len(sub.queue))
+	}
+}
+
+func TestSubscriberDrainBatchLimit(t *testing.T) {
+	sub := &subscriber{queue: make(chan sseMessage, subscriberQueueSize)}
+	for n := 0; n < subscriberQueueSize; n++ {
+		sub.queue <- sseMessage{ID: uint64(n + 2), Event: eventEntryCreated}
+	}
+	if got := sub.drain(sseMessage{ID: 1, Event: eventEntryCreated}); len(got) != subscriberQueueSize {
+		t.Errorf("drain returned %d messages, want %d", len(got), subscriberQueueSize)
+	}
+	if len(sub.queue) != 1 {
+		t.Errorf("%d messages left in the queue, want 1", len(sub.queue))
+	}
+}
+
+func TestHubUnsubscribe(t *testing.T) {
+	h := newTestHub()
+	stay, _ := h.Subscribe("", "", "stay", "Stay")
+	leave, _ := h.Subscribe("", "", "leave", "Leave")
+	queued(stay)
+
+	h.Publish("", sseMessage{Event: eventEntryCreated, Data: "before"})
+	h.Unsubscribe(leave)
+	h.Unsubscribe(leave)
+	h.Publish("", sseMessage{Event: eventEntryCreated, Data: "after"})
+
+	// What was queued before leaving can still be drained, and nothing after
+	msgs := queued(leave)
+	if len(msgs) != 1 || msgs[0].Data != "before" {
+		t.Errorf("unsubscribed subscriber got %+v", msgs)
+	}
+	msgs = queued(stay)
+	if len(msgs) != 3 || msgs[1].Event != eventPresenceUpdated || msgs[2].Data != "after" {
+		t.Errorf("remaining subscriber got %+v", msgs)
+	}
+	if got := h.Subscribers(""); got != 1 {
+		t.Errorf("Subscribers() = %d, want 1", got)
+	}
+}
+
+func TestHubSubscriberCounts(t *testing.T) {
+	const perRoom = 1000
+	rooms := []string{"", "team", "family"}
+	h := newTestHub()
+	subs := make(chan *subscriber, perRoom*len(rooms))
+	var wg sync.WaitGroup
+	for _, room := range rooms {
+		for i := 0; i < perRoom; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sub, _ := h.Subscribe(room, "", "device-"+strconv.Itoa(i%10), "Device")
+				subs <- sub
+			}()
+		}
+	}
+	wg.Wait()
+	close(subs)
+	for _, room := range rooms {
+		if got := h.Subscribers(room); got != perRoom {
+			t.Errorf("Subscribers(%q) = %d, want %d", room, got, perRoom)
+		}
+	}
+	if got := h.TotalSubscribers(); got != perRoom*len(rooms) {
+		t.Errorf("TotalSubscribers() = %d, want %d", got, perRoom*len(rooms))
+	}
+
+	for sub := range subs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Unsubscribe(sub)
+		}()
+	}
+	wg.Wait()
+	if got := h.TotalSubscribers(); got != 0 {
+		t.Errorf("TotalSubscribers() = %d after unsubscribing, want 0", got)
+	}
+	if len(h.rooms) != 0 {
+		t.Errorf("%d empty rooms left behind", len(h.rooms))
+	}
+}
+
+func TestEventHistorySince(t *testing.T) {
+	history := &EventHistory{dirty: make(chan struct{}, 1)}
+	history.append(sseMessage{Room: "a", Data: "1"})
+	history.append(sseMessage{Room: "b", Data: "2"})
+	history.append(sseMessage{Room: "a", Device: "phone", Data: "3"})
+	history.append(sseMessage{Room: "a", Device: "laptop", Data: "4"})
+	history.append(sseMessage{Room: "a", Data: "5"})
+
+	for _, tc := range []struct {
+		device string
+		lastID uint64
+		want   string
+		ok     bool
+	}{
+		{"phone", 0, "135", true},
+		{"laptop", 0, "145", true},
+		{"phone", 3, "5", true},
+		{"phone", 5, "", true},
+		{"phone", 6, "", false},
+	} {
+		msgs, ok := history.since("a", tc.device, tc.lastID)
+		got := ""
+		for _, msg := range msgs {
+			got += msg.Data
+		}
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("since(a, %s, %d) = %q, %v; want %q, %v", tc.device, tc.lastID, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	// Once the oldest messages are dropped they can't be replayed
+	for n := 0; n < eventHistorySize; n++ {
+		history.append(sseMessage{Room: "b", Data: "filler"})
+	}
+	if _, ok := history.since("a", "phone", 3); ok {
+		t.Error("since() replayed from a message no longer kept")
+	}
+	if msgs, ok := history.since("a", "phone", 6); !ok || len(msgs) != 0 {
+		t.Errorf("since() from the oldest kept message = %+v, %v", msgs, ok)
+	}
+}
+
+func TestEventHistoryKeepsOnlyIDs(t *testing.T) {
+	history := &EventHistory{dirty: make(chan struct{}, 1)}
+	data := `{"id":"text/snip","previousId":"text/old","entry":{"id":"text/snip","content":"secret"}}`
+	msg := history.append(sseMessage{Event: eventEntryUpdated, Data: data})
+	if msg.Data != data {
+		t.Errorf("append() returned %q, want the full payload for live subscribers", msg.Data)
+	}
+	if got, want := history.Events[0].Data, `{"id":"text/snip","previousId":"text/old"}`; got != want {
+		t.Errorf("history kept %q, want %q", got, want)
+	}
+	if history.size != len(history.Events[0].Data) {
+		t.Errorf("history size = %d, want that of the kept message", history.size)
+	}
+}
+
+func TestHubSubscribeCatchUp(t *testing.T) {
+	h := newTestHub()
+	h.Publish("a", sseMessage{Event: eventEntryCreated, Data: "first"})
+	h.Publish("b", sseMessage{Event: eventEntryCreated, Data: "elsewhere"})
+	h.Publish("a", sseMessage{Event: eventEntryDeleted, Data: "second"})
+
+	_, catchUp := h.Subscribe("a", "1", "device", "Device")
+	if len(catchUp) != 3 || catchUp[0].Data != "second" || catchUp[1].Data != "connected" || catchUp[2].Event != eventPresenceUpdated {
+		t.Errorf("catching up from 1 sent %+v", catchUp)
+	}
+	if catchUp[1].ID != 3 {
+		t.Errorf("connected message has ID %d, want 3", catchUp[1].ID)
+	}
+
+	for _, lastEventID := range []string{"99", "not-a-number"} {
+		_, catchUp = h.Subscribe("a", lastEventID, "device", "Device")
+		if len(catchUp) == 0 || catchUp[0].Event != eventResyncRequired {
+			t.Errorf("catching up from %q sent %+v, want %s first", lastEventID, catchUp, eventResyncRequired)
+		}
+	}
+
+	_, catchUp = h.Subscribe("a", "", "device", "Device")
+	if len(catchUp) != 2 || catchUp[0].Data != "connected" {
+		t.Errorf("subscribing afresh sent %+v", catchUp)
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Metadata stripping is off by default; STRIP_METADATA=true turns it on and
+// the "strip-metadata" form field overrides it per upload
+var stripMetadataDefault = false
+
+var errMalformedImage = errors.New("malformed image")
+
+func initMetadataStripping() {
+	switch strings.ToLower(os.Getenv("STRIP_METADATA")) {
+	case "true", "1", "yes":
+		stripMetadataDefault = true
+		log.Println("Image metadata stripping enabled by default.")
+	}
+}
+
+// Resolves the per-upload override against the global default
+func shouldStripMetadata(formValue string) bool {
+	switch strings.ToLower(formValue) {
+	case "true", "on", "1":
+		return true
+	case "false", "off", "0":
+		return false
+	}
+	return stripMetadataDefault
+}
+
+func canStripMetadata(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg", ".png", ".webp", ".heic", ".heif":
+		return true
+	}
+	return false
+}
+
+// Removes EXIF/XMP/IPTC metadata from an image file in place, keeping it
+// upright: JPEG and PNG are rotated by their EXIF orientation, while WebP and
+// HEIF keep only the orientation (see stripWebP and stripHEIF)
+func stripImageMetadata(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var out []byte
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		out, err = stripJPEG(data)
+	case ".png":
+		out, err = stripPNG(data)
+	case ".webp":
+		out, err = stripWebP(data)
+	case ".heic", ".heif":
+		out, err = stripHEIF(data)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".strip"
+	if err := os.WriteFile(tmpPath, out, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// Reads the orientation tag (0x0112) from a TIFF-structured EXIF block
+func exifOrientation(tiff []byte) int {
+	tiff = bytes.TrimPrefix(tiff, []byte("Exif\x00\x00"))
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// Builds a minimal little-endian EXIF block holding only the orientation tag
+func orientationOnlyEXIF(orientation int) []byte {
+	b := []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 1, 0}
+	b = binary.LittleEndian.AppendUint16(b, 0x0112)
+	b = binary.LittleEndian.AppendUint16(b, 3) // SHORT
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, uint16(orientation))
+	b = append(b, 0, 0, 0, 0, 0, 0) // value padding and next IFD offset
+	return b
+}
+
+// Returns a copy of img transformed according to an EXIF orientation value
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirror horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// Returns the EXIF orientation of a JPEG file, or 1 if it has none
+func jpegOrientation(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+	header := make([]byte, 128<<10) // EXIF must fit in a single 64 KiB APP1 segment near the start
+	n, _ := f.Read(header)
+	segments, _, _ := jpegSegments(header[:n]) // a truncated header still yields the leading segments
+	for _, seg := range segments {
+		if seg[1] == 0xE1 && bytes.HasPrefix(seg[4:], []byte("Exif\x00\x00")) {
+			return exifOrientation(seg[4:])
+		}
+	}
+	return 1
+}
+
+// Splits a JPEG into its header segments (everything before SOS, each
+// including its marker) and the remaining scan data
+func jpegSegments(data []byte) ([][]byte, []byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, nil, errMalformedImage
+	}
+	var segments [][]byte
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return segments, nil, errMalformedImage
+		}
+		marker := data[pos+1]
+		if marker == 0xFF { // fill byte
+			pos++
+			continue
+		}
+		if marker == 0xDA { // start of scan, the rest is image data
+			return segments, data[pos:], nil
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return segments, nil, errMalformedImage
+		}
+		segments = append(segments, data[pos:pos+2+length])
+		pos += 2 + length
+	}
+	return segments, nil, errMalformedImage
+}
+
+func stripJPEG(data []byte) ([]byte, error) {
+	segments, scan, err := jpegSegments(data)
+	if err != nil {
+		return nil, err
+	}
+	orientation := 1
+	var kept, icc [][]byte
+	for _, seg := range segments {
+		marker := seg[1]
+		payload := seg[4:]
+		switch {
+		case marker == 0xE1: // EXIF or XMP
+			if bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+				orientation = exifOrientation(payload)
+			}
+		case marker == 0xE2: // keep colour profiles, drop MPF and others
+			if bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")) {
+				kept = append(kept, seg)
+				icc = append(icc, seg)
+			}
+		case marker == 0xE0 || marker == 0xEE: // JFIF and Adobe are needed to decode correctly
+			kept = append(kept, seg)
+		case marker >= 0xE3 && marker <= 0xEF, marker == 0xFE: // other APPn (incl. IPTC) and comments
+		default:
+			kept = append(kept, seg)
+		}
+	}
+	if orientation != 1 {
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, applyOrientation(img, orientation), &jpeg.Options{Quality: 92}); err != nil {
+			return nil, err
+		}
+		// The encoder writes no metadata, so only the colour profile needs restoring
+		encoded := buf.Bytes()
+		out := append([]byte{}, encoded[:2]...)
+		for _, seg := range icc {
+			out = append(out, seg...)
+		}
+		return append(out, encoded[2:]...), nil
+	}
+	out := []byte{0xFF, 0xD8}
+	for _, seg := range kept {
+		out = append(out, seg...)
+	}
+	// Drop anything after EOI, such as MPF secondary images carrying their own EXIF
+	if end := bytes.Index(scan, []byte{0xFF, 0xD9}); end >= 0 {
+		scan = scan[:end+2]
+	}
+	return append(out, scan...), nil
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	const sigLen = 8
+	if len(data) < sigLen || !bytes.Equal(data[:sigLen], []byte("\x89PNG\r\n\x1a\n")) {
+		return nil, errMalformedImage
+	}
+	out := append([]byte{}, data[:sigLen]...)
+	orientation := 1
+	pos := sigLen
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errMalformedImage
+		}
+		switch string(data[pos+4 : pos+8]) {
+		case "eXIf":
+			orientation = exifOrientation(data[pos+8 : pos+8+length])
+		case "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+	if orientation != 1 {
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, applyOrientation(img, orientation)); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return out, nil
+}
+
+// Unlike JPEG and PNG, WebP is not rotated: there is no WebP encoder to
+// write the turned pixels with. A non-default orientation is kept instead, as
+// an EXIF chunk holding nothing but that tag, for viewers to apply
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errMalformedImage
+	}
+	var chunks [][]byte
+	vp8x := -1
+	orientation := 1
+	pos := 12
+	for pos+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size%2
+		if end > len(data) {
+			end = len(data)
+		}
+		switch string(data[pos : pos+4]) {
+		case "EXIF":
+			orientation = exifOrientation(data[pos+8 : min(pos+8+size, len(data))])
+		case "XMP ":
+		case "VP8X":
+			vp8x = len(chunks)
+			chunks = append(chunks, append([]byte{}, data[pos:end]...))
+		default:
+			chunks = append(chunks, data[pos:end])
+		}
+		pos = end
+	}
+	if vp8x >= 0 && len(chunks[vp8x]) > 8 {
+		chunks[vp8x][8] &^= 0x08 | 0x04 // EXIF and XMP flags
+		if orientation != 1 {
+			chunks[vp8x][8] |= 0x08
+		}
+	}
+	if orientation != 1 && vp8x >= 0 {
+		exif := orientationOnlyEXIF(orientation)
+		chunk := binary.LittleEndian.AppendUint32([]byte("EXIF"), uint32(len(exif)))
+		chunks = append(chunks, append(chunk, exif...))
+	}
+	out := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// HEIF orientation lives in the irot/imir properties rather than EXIF, so
+// the Exif and XMP items are simply zeroed where they sit in the file
+func stripHEIF(data []byte) ([]byte, error) {
+	meta := findBox(data, "meta")
+	if meta == nil || len(meta) < 4 {
+		return nil, errMalformedImage
+	}
+	meta = meta[4:] // version and flags
+	metadataItems := heifMetadataItems(findBox(meta, "iinf"))
+	if len(metadataItems) == 0 {
+		return data, nil
+	}
+	extents, err := heifItemExtents(findBox(meta, "iloc"), metadataItems)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, data...)
+	for _, ext := range extents {
+		if ext[0] < 0 || ext[1] < 0 || ext[0] > len(out) || ext[1] > len(out)-ext[0] {
+			return nil, errMalformedImage
+		}
+		clear(out[ext[0] : ext[0]+ext[1]])
+	}
+	return out, nil
+}
+
+// Returns the payload of the first box of the given type in an ISOBMFF box list
+func findBox(data []byte, boxType string) []byte {
+	pos := 0
+	for pos+8 <= len(data) {
+		size := uint64(binary.BigEndian.Uint32(data[pos:]))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data) - pos)
+		case 1:
+			if pos+16 > len(data) {
+				return nil
+			}
+			size = binary.BigEndian.Uint64(data[pos+8:])
+			header = 16
+		}
+		// Compared before converting, as a 64-bit size may not fit in an int
+		if size < header || size > uint64(len(data)-pos) {
+			return nil
+		}
+		if string(data[pos+4:pos+8]) == boxType {
+			return data[pos+int(header) : pos+int(size)]
+		}
+		pos += int(size)
+	}
+	return nil
+}
+
+// Returns the IDs of Exif and XMP items listed in an iinf box
+func heifMetadataItems(iinf []byte) map[uint32]bool {
+	items := make(map[uint32]bool)
+	if len(iinf) < 6 {
+		return items
+	}
+	pos := 6
+	if iinf[0] != 0 {
+		pos = 8
+	}
+	for pos+8 <= len(iinf) {
+		size := int(binary.BigEndian.Uint32(iinf[pos:]))
+		if size < 8 || pos+size > len(iinf) {
+			break
+		}
+		if string(iinf[pos+4:pos+8]) == "infe" {
+			infe := iinf[pos+8 : pos+size]
+			if len(infe) >= 4 && infe[0] >= 2 {
+				var id uint32
+				rest := infe[4:]
+				if infe[0] == 2 && len(rest) >= 8 {
+					id, rest = uint32(binary.BigEndian.Uint16(rest)), rest[4:]
+				} else if len(rest) >= 10 {
+					id, rest = binary.BigEndian.Uint32(rest), rest[6:]
+				}
+				if len(rest) >= 4 {
+					itemType := string(rest[:4])
+					if itemType == "Exif" || (itemType == "mime" && bytes.Contains(rest, []byte("rdf+xml"))) {
+						items[id] = true
+					}
+				}
+			}
+		}
+		pos += size
+	}
+	return items
+}
+
+// Returns absolute {offset, length} extents in the file for the given items
+func heifItemExtents(iloc []byte, items map[uint32]bool) ([][2]int, error) {
+	if len(iloc) < 8 {
+		return nil, errMalformedImage
+	}
+	version := iloc[0]
+	offsetSize := int(iloc[4] >> 4)
+	lengthSize := int(iloc[4] & 0x0F)
+	baseOffsetSize := int(iloc[5] >> 4)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(iloc[5] & 0x0F)
+	}
+	for _, size := range []int{offsetSize, lengthSize, baseOffsetSize, indexSize} {
+		if size != 0 && size != 4 && size != 8 {
+			return nil, errMalformedImage
+		}
+	}
+	pos := 6
+	// Values too large for any file are refused, so offsets can be added safely
+	readN := func(n int) (int, bool) {
+		if n > len(iloc)-pos {
+			return 0, false
+		}
+		var v uint64
+		for i := 0; i < n; i++ {
+			v = v<<8 | uint64(iloc[pos+i])
+		}
+		if v > math.MaxInt/2 {
+			return 0, false
+		}
+		pos += n
+		return int(v), true
+	}
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+	itemCount, ok := readN(idSize)
+	if !ok {
+		return nil, errMalformedImage
+	}
+	var extents [][2]int
+	for i := 0; i < itemCount; i++ {
+		id, ok := readN(idSize)
+		if !ok {
+			return nil, errMalformedImage
+		}
+		constructionMethod := 0
+		if version == 1 || version == 2 {
+			v, ok := readN(2)
+			if !ok {
+				return nil, errMalformedImage
+			}
+			constructionMethod = v & 0x0F
+		}
+		if _, ok := readN(2); !ok { // data reference index
+			return nil, errMalformedImage
+		}
+		baseOffset, ok := readN(baseOffsetSize)
+		if !ok {
+			return nil, errMalformedImage
+		}
+		extentCount, ok := readN(2)
+		if !ok {
+			return nil, errMalformedImage
+		}
+		for j := 0; j < extentCount; j++ {
+			if _, ok := readN(indexSize); !ok {
+				return nil, errMalformedImage
+			}
+			offset, ok1 := readN(offsetSize)
+			length, ok2 := readN(lengthSize)
+			if !ok1 || !ok2 {
+				return nil, errMalformedImage
+			}
+			// Only file-offset items are rewritten; idat-stored metadata is left alone
+			if items[uint32(id)] && constructionMethod == 0 {
+				extents = append(extents, [2]int{baseOffset + offset, length})
+			}
+		}
+	}
+	return extents, nil
+}
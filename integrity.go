@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// BLAKE3 digests are computed alongside SHA-256 when BLAKE3_DIGESTS=true or
+// when a client sends an expected BLAKE3 digest with its upload
+var blake3Enabled = false
+
+var errDigestMismatch = errors.New("digest mismatch")
+
+func initIntegrity() {
+	switch strings.ToLower(os.Getenv("BLAKE3_DIGESTS")) {
+	case "true", "1", "yes":
+		blake3Enabled = true
+		log.Println("BLAKE3 digests enabled.")
+	}
+}
+
+// Hashes everything written to it, so uploads are digested while streaming to disk
+type digestWriter struct {
+	sha256 hash.Hash
+	blake3 hash.Hash // nil unless requested
+}
+
+func newDigestWriter(withBlake3 bool) *digestWriter {
+	d := &digestWriter{sha256: sha256.New()}
+	if withBlake3 {
+		d.blake3 = blake3.New(32, nil)
+	}
+	return d
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	d.sha256.Write(p)
+	if d.blake3 != nil {
+		d.blake3.Write(p)
+	}
+	return len(p), nil
+}
+
+func (d *digestWriter) SHA256() string {
+	return hex.EncodeToString(d.sha256.Sum(nil))
+}
+
+func (d *digestWriter) BLAKE3() string {
+	if d.blake3 == nil {
+		return ""
+	}
+	return hex.EncodeToString(d.blake3.Sum(nil))
+}
+
+type expectedDigests struct {
+	sha256 string
+	blake3 string
+}
+
+// Returns the digests a client expects for the i-th uploaded file, taken from
+// the repeated "sha256"/"blake3" form fields or, for single-file uploads, the
+// X-Expected-SHA256/X-Expected-BLAKE3 headers
+func expectedDigestsFor(r *http.Request, i, total int) expectedDigests {
+	pick := func(field, header string) string {
+		if values := r.MultipartForm.Value[field]; i < len(values) {
+			return strings.ToLower(strings.TrimSpace(values[i]))
+		}
+		if total == 1 {
+			return strings.ToLower(strings.TrimSpace(r.Header.Get(header)))
+		}
+		return ""
+	}
+	return expectedDigests{
+		sha256: pick("sha256", "X-Expected-SHA256"),
+		blake3: pick("blake3", "X-Expected-BLAKE3"),
+	}
+}
+
+func (e expectedDigests) verify(d *digestWriter) error {
+	if e.sha256 != "" && e.sha256 != d.SHA256() {
+		return fmt.Errorf("%w: expected SHA-256 %s, got %s", errDigestMismatch, e.sha256, d.SHA256())
+	}
+	if e.blake3 != "" && e.blake3 != d.BLAKE3() {
+		return fmt.Errorf("%w: expected BLAKE3 %s, got %s", errDigestMismatch, e.blake3, d.BLAKE3())
+	}
+	return nil
+}
+
+func blake3File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := blake3.New(32, nil)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Sets the RFC 9530 Repr-Digest header, plus the legacy RFC 3230 Digest
+// header when the full body is being sent
+func setDigestHeaders(w http.ResponseWriter, r *http.Request, sha256Hex string) {
+	sum, err := hex.DecodeString(sha256Hex)
+	if err != nil || len(sum) != sha256.Size {
+		return
+	}
+	encoded := base64.StdEncoding.EncodeToString(sum)
+	w.Header().Set("Repr-Digest", "sha-256=:"+encoded+":")
+	if r.Header.Get("Range") == "" {
+		w.Header().Set("Digest", "SHA-256="+encoded)
+	}
+}
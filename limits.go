@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size limits read from the environment; zero means unlimited
+type StorageLimits struct {
+	MaxFileSize    int64 // per uploaded file (MAX_FILE_SIZE)
+	MaxSnippetSize int64 // per snippet or notepad body (MAX_SNIPPET_SIZE)
+	MaxTotal       int64 // across all stored content (MAX_TOTAL_STORAGE)
+	MinFree        int64 // free disk space always left untouched (MIN_FREE_SPACE)
+}
+
+type StorageUsage struct {
+	Used     int64 `json:"used"`
+	MaxTotal int64 `json:"maxTotal"`
+	Free     int64 `json:"free"` // -1 when the platform can't report it
+}
+
+var storageLimits StorageLimits
+
+var (
+	errFileTooLarge    = errors.New("file too large")
+	errSnippetTooLarge = errors.New("snippet too large")
+	errStorageFull     = errors.New("storage limit reached")
+	errDiskFull        = errors.New("not enough free disk space")
+)
+
+// Extra room for multipart boundaries and form fields around the file bodies
+const multipartOverhead = 1 << 20
+
+func initStorageLimits() {
+	for _, limit := range []struct {
+		env   string
+		value *int64
+	}{
+		{"MAX_FILE_SIZE", &storageLimits.MaxFileSize},
+		{"MAX_SNIPPET_SIZE", &storageLimits.MaxSnippetSize},
+		{"MAX_TOTAL_STORAGE", &storageLimits.MaxTotal},
+		{"MIN_FREE_SPACE", &storageLimits.MinFree},
+	} {
+		raw := os.Getenv(limit.env)
+		if raw == "" {
+			continue
+		}
+		size, err := parseByteSize(raw)
+		if err != nil {
+			log.Fatalf("Invalid %s value %q: %v", limit.env, raw, err)
+		}
+		*limit.value = size
+		log.Printf("%s set to %s", limit.env, formatBytes(size))
+	}
+}
+
+// Parses sizes like 512, 100K, 20M, 1.5G or 2T (binary units, optional B/iB suffix)
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(strings.ToUpper(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("expected a size like 500M or 2G")
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// Every save checks the total, so the walk behind it is reused for a couple of
+// seconds; storing or removing a file starts a fresh one
+const dataUsageCacheTTL = 2 * time.Second
+
+type DataUsageCache struct {
+	total    int64
+	computed time.Time
+	mu       sync.Mutex // mutex for thread safety
+}
+
+var dataUsageCache DataUsageCache
+
+// Returns the stored content's size, walking the data directory if the last
+// walk is stale
+func dataUsage() int64 {
+	dataUsageCache.mu.Lock()
+	defer dataUsageCache.mu.Unlock()
+	if dataUsageCache.computed.IsZero() || time.Since(dataUsageCache.computed) >= dataUsageCacheTTL {
+		dataUsageCache.total = walkDataUsage()
+		dataUsageCache.computed = time.Now()
+	}
+	return dataUsageCache.total
+}
+
+// Makes the next dataUsage call walk the data directory again
+func invalidateDataUsage() {
+	dataUsageCache.mu.Lock()
+	dataUsageCache.computed = time.Time{}
+	dataUsageCache.mu.Unlock()
+}
+
+// Sums the stored content: blobs once each, plus snippets, notepads and links
+func walkDataUsage() int64 {
+	var total int64
+	add := func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		return nil
+	}
+	blobDirs, _ := os.ReadDir(filepath.Join("data", "blobs"))
+	for _, dir := range blobDirs {
+		if dir.IsDir() && dir.Name() != "tmp" {
+			filepath.WalkDir(filepath.Join("data", "blobs", dir.Name()), add)
+		}
+	}
+	prefixes := []string{""}
+	for _, room := range roomTracker.List() {
+		prefixes = append(prefixes, room.Prefix())
+	}
+	for _, prefix := range prefixes {
+		filepath.WalkDir(filepath.Join("data", prefix, "text"), add)
+		filepath.WalkDir(filepath.Join("data", prefix, "notepad"), add)
+		if info, err := os.Stat(filepath.Join("data", prefix, "links.file")); err == nil {
+			total += info.Size()
+		}
+		// Files that never made it into the blob store (no hard link support)
+		files, _ := os.ReadDir(filepath.Join("data", prefix, "files"))
+		for _, file := range files {
+			if meta := metadataTracker.Get(prefix + "files/" + file.Name()); meta == nil || meta.Hash == "" {
+				if info, err := file.Info(); err == nil && !file.IsDir() {
+					total += info.Size()
+				}
+			}
+		}
+	}
+	return total
+}
+
+func currentUsage() StorageUsage {
+	return StorageUsage{
+		Used:     dataUsage(),
+		MaxTotal: storageLimits.MaxTotal,
+		Free:     diskFree("data"),
+	}
+}
+
+// Returns how many more bytes may be stored, or -1 if there is no limit
+func storageBudget() int64 {
+	budget := int64(-1)
+	if storageLimits.MaxTotal > 0 {
+		budget = max(0, storageLimits.MaxTotal-dataUsage())
+	}
+	if storageLimits.MinFree > 0 {
+		if free := diskFree("data"); free >= 0 {
+			available := max(0, free-storageLimits.MinFree)
+			if budget < 0 || available < budget {
+				budget = available
+			}
+		}
+	}
+	return budget
+}
+
+// Checks that n more bytes fit within the total limit and free space reserve
+func checkStorageAvailable(n int64) error {
+	if storageLimits.MaxTotal > 0 {
+		if used := dataUsage(); used+n > storageLimits.MaxTotal {
+			return fmt.Errorf("%w: %s of %s already used", errStorageFull, formatBytes(used), formatBytes(storageLimits.MaxTotal))
+		}
+	}
+	if storageLimits.MinFree > 0 {
+		if free := diskFree("data"); free >= 0 && free-n < storageLimits.MinFree {
+			return fmt.Errorf("%w: %s free, %s must stay available", errDiskFull, formatBytes(free), formatBytes(storageLimits.MinFree))
+		}
+	}
+	return nil
+}
+
+func checkFileSize(name string, size int64) error {
+	if storageLimits.MaxFileSize > 0 && size > storageLimits.MaxFileSize {
+		return fmt.Errorf("%w: %s is %s, the maximum is %s", errFileTooLarge, name, formatBytes(size), formatBytes(storageLimits.MaxFileSize))
+	}
+	return nil
+}
+
+// Streams a multipart body through a check of each file's size, so a file
+// over limit fails the upload as soon as that much of it has arrived rather
+// than after being spooled to disk whole. The returned function must be
+// called once the form is read
+func limitMultipartFiles(r *http.Request, limit int64) func() {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return func() {}
+	}
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	if err := mw.SetBoundary(params["boundary"]); err != nil {
+		return func() {}
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	go func() {
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				pw.CloseWithError(mw.Close())
+				return
+			} else if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			dst, err := mw.CreatePart(part.Header)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			src := io.Reader(part)
+			if part.FileName() != "" {
+				src = io.LimitReader(part, limit+1)
+			}
+			n, err := io.Copy(dst, src)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if part.FileName() != "" && n > limit {
+				pw.CloseWithError(fmt.Errorf("%w: %s is over the maximum of %s", errFileTooLarge, part.FileName(), formatBytes(limit)))
+				return
+			}
+		}
+	}()
+	r.Body = pr
+	return func() { pr.Close() }
+}
+
+func checkSnippetSize(size int) error {
+	if storageLimits.MaxSnippetSize > 0 && int64(size) > storageLimits.MaxSnippetSize {
+		return fmt.Errorf("%w: %s, the maximum is %s", errSnippetTooLarge, formatBytes(int64(size)), formatBytes(storageLimits.MaxSnippetSize))
+	}
+	return nil
+}
+
+// Maps storage errors to 413/507 responses with a readable message
+func writeStorageError(w http.ResponseWriter, err error) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errFileTooLarge), errors.Is(err, errSnippetTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errStorageFull), errors.Is(err, errDiskFull), errors.Is(err, errQuotaExceeded):
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	case errors.As(err, &maxBytesErr):
+		http.Error(w, "Upload exceeds the remaining storage space", http.StatusInsufficientStorage)
+	case isDiskFullError(err):
+		log.Printf("Disk full: %v", err)
+		http.Error(w, "The server has run out of disk space", http.StatusInsufficientStorage)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
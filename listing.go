@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Entries are listed newest first by default and can be sorted by creation or
+// modification time, name, size, or expiry. Pages are addressed by an opaque
+// cursor holding the sort key of the last entry shown, so paging stays stable
+// while entries are added or removed. Pinned entries always come first
+const maxPageSize = 500
+
+// Number of entries per page on the home page, set with PAGE_SIZE
+var pageSize = 50
+
+var sortFields = []string{"created", "modified", "name", "size", "expiry"}
+
+var errInvalidCursor = errors.New("invalid or mismatched cursor")
+
+type ListOptions struct {
+	Sort   string
+	Desc   bool
+	Limit  int // 0 lists everything
+	Cursor *listCursor
+}
+
+// Position of an entry in a listing; also the decoded form of a cursor
+type listCursor struct {
+	Sort   string `json:"s"`
+	Desc   bool   `json:"d,omitempty"`
+	Pinned bool   `json:"p,omitempty"`
+	Num    int64  `json:"n,omitempty"` // times, sizes, and expiries
+	Str    string `json:"t,omitempty"` // names
+	ID     string `json:"i"`
+}
+
+func initPageSize() {
+	raw := os.Getenv("PAGE_SIZE")
+	if raw == "" {
+		return
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n <= 0 || n > maxPageSize {
+		log.Fatalf("Invalid PAGE_SIZE value %q: must be between 1 and %d", raw, maxPageSize)
+	}
+	pageSize = n
+	log.Printf("PAGE_SIZE set to %d", n)
+}
+
+// Names and expiries read best soonest and A-Z first, the rest largest and newest first
+func defaultDesc(field string) bool {
+	return field != "name" && field != "expiry"
+}
+
+// Reads the sort, order, limit, and cursor query parameters. A limit of 0
+// means defaultLimit, which may itself be 0 for no limit
+func parseListOptions(query url.Values, defaultLimit int) (ListOptions, error) {
+	opts := ListOptions{Sort: strings.ToLower(query.Get("sort")), Limit: defaultLimit}
+	if opts.Sort == "" {
+		opts.Sort = "created"
+	}
+	if !slices.Contains(sortFields, opts.Sort) {
+		return opts, fmt.Errorf("unknown sort %q, expected one of %s", opts.Sort, strings.Join(sortFields, ", "))
+	}
+	switch strings.ToLower(query.Get("order")) {
+	case "":
+		opts.Desc = defaultDesc(opts.Sort)
+	case "asc":
+		opts.Desc = false
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, fmt.Errorf("unknown order %q, expected asc or desc", query.Get("order"))
+	}
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return opts, fmt.Errorf("invalid limit %q", raw)
+		}
+		if n > 0 {
+			opts.Limit = min(n, maxPageSize)
+		}
+	}
+	if raw := query.Get("cursor"); raw != "" {
+		cursor, err := decodeCursor(raw)
+		if err != nil || cursor.Sort != opts.Sort || cursor.Desc != opts.Desc {
+			return opts, errInvalidCursor
+		}
+		opts.Cursor = cursor
+	}
+	return opts, nil
+}
+
+// The value of the query string's "order" parameter for these options
+func (o ListOptions) Order() string {
+	if o.Desc {
+		return "desc"
+	}
+	return "asc"
+}
+
+func (o ListOptions) key(entry Entry) *listCursor {
+	key := &listCursor{Sort: o.Sort, Desc: o.Desc, Pinned: entry.Pinned, ID: entry.ID}
+	switch o.Sort {
+	case "created":
+		key.Num = entry.Created.UnixNano()
+	case "modified":
+		key.Num = entry.Modified.UnixNano()
+	case "name":
+		key.Str = strings.ToLower(entry.Filename)
+	case "size":
+		key.Num = entry.Size
+	case "expiry":
+		key.Num = math.MaxInt64 // never
+		if entry.Expires != nil {
+			key.Num = entry.Expires.UnixNano()
+		}
+	}
+	return key
+}
+
+// Orders pinned entries first, then by the sort field, then by ID so that every
+// entry has a distinct position
+func (o ListOptions) less(a, b *listCursor) bool {
+	if a.Pinned != b.Pinned {
+		return a.Pinned
+	}
+	if a.Str != b.Str {
+		return (a.Str < b.Str) != o.Desc
+	}
+	if a.Num != b.Num {
+		return (a.Num < b.Num) != o.Desc
+	}
+	return a.ID < b.ID
+}
+
+// Sorts entries and returns the page after the cursor, along with the cursor
+// for the next page ("" on the last one)
+func paginateEntries(entries []Entry, opts ListOptions) ([]Entry, string) {
+	keys := make([]*listCursor, len(entries))
+	order := make([]int, len(entries))
+	for i, entry := range entries {
+		keys[i] = opts.key(entry)
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return opts.less(keys[order[i]], keys[order[j]]) })
+	start := 0
+	if opts.Cursor != nil {
+		start = sort.Search(len(order), func(i int) bool { return opts.less(opts.Cursor, keys[order[i]]) })
+	}
+	end := len(order)
+	if opts.Limit > 0 {
+		end = min(end, start+opts.Limit)
+	}
+	page := make([]Entry, 0, end-start)
+	for _, i := range order[start:end] {
+		page = append(page, entries[i])
+	}
+	next := ""
+	if end < len(order) {
+		next = encodeCursor(keys[order[end-1]])
+	}
+	return page, next
+}
+
+func encodeCursor(cursor *listCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(raw string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, err
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
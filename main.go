@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -13,8 +16,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,17 +29,47 @@ import (
 //go:embed templates/* static/*
 var content embed.FS
 
-// SSE client management
-var (
-	clients   = make(map[chan string]bool)
-	clientMux sync.Mutex
-)
+// How long a write to an SSE client may take before it is dropped
+const sseWriteTimeout = 10 * time.Second
 
 type Entry struct {
-	ID       string
-	Content  string
-	Type     string
-	Filename string
+	ID         string     `json:"id"`
+	Content    string     `json:"content,omitempty"`
+	Type       string     `json:"type"`
+	Filename   string     `json:"filename"`
+	Thumbnail  string     `json:"thumbnail,omitempty"`
+	Hash       string     `json:"sha256,omitempty"`
+	Blake3     string     `json:"blake3,omitempty"`
+	Tags       []string   `json:"tags,omitempty"`
+	Pinned     bool       `json:"pinned,omitempty"`
+	Collection string     `json:"collection,omitempty"`
+	Size       int64      `json:"size"` // decoded size in bytes
+	Created    time.Time  `json:"created"`
+	Modified   time.Time  `json:"modified"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	From       string     `json:"from,omitempty"`    // sender's name, for entries sent to this device
+	Pending    bool       `json:"pending,omitempty"` // sent here and not yet accepted
+}
+
+// Data passed to the index.html template
+type IndexPage struct {
+	Entries       []Entry
+	StripMetadata bool
+	Usage         StorageUsage
+	Limits        StorageLimits
+	Device        DeviceUsage
+	Tags          []TagCount
+	Tag           string // active tag filter
+	Sort          string
+	Order         string
+	Cursor        string // cursor of the current page, empty on the first
+	NextCursor    string
+	Collections   []CollectionCount
+	Collection    *Collection // set on a collection's page
+	BasePath      string      // the room's home or the collection's page
+	Room          *Room       // nil for the default room
+	RoomPath      string      // prefix of the room's URLs, "" for the default room
+	EventID       uint64      // latest update when the page was rendered
 }
 
 type ExpirationTracker struct {
@@ -127,6 +162,34 @@ func (t *ExpirationTracker) SetExpiration(fileID, expiryOption string) {
 	t.saveToFile()
 }
 
+func (t *ExpirationTracker) Remove(fileID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.Expirations[fileID]; ok {
+		delete(t.Expirations, fileID)
+		t.saveToFile()
+	}
+}
+
+// Moves an entry's expiration to its new ID
+func (t *ExpirationTracker) Rename(oldID, newID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if expiry, ok := t.Expirations[oldID]; ok {
+		delete(t.Expirations, oldID)
+		t.Expirations[newID] = expiry
+		t.saveToFile()
+	}
+}
+
+// Returns when an entry expires, if it has an expiration
+func (t *ExpirationTracker) Get(fileID string) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	expiry, ok := t.Expirations[fileID]
+	return expiry, ok
+}
+
 func (t *ExpirationTracker) saveToFile() {
 	data, err := json.MarshalIndent(t, "", "  ")
 	if err != nil {
@@ -146,13 +209,16 @@ func (t *ExpirationTracker) CleanupExpired() []string {
 	var expiredFiles []string
 	// Find expired files
 	for fileID, expiryTime := range t.Expirations {
-		if now.After(expiryTime) {
+		// Pinned entries are kept until they are unpinned
+		if now.After(expiryTime) && !isPinned(fileID) {
 			expiredFiles = append(expiredFiles, fileID)
 		}
 	}
-	// Delete expired files
+	// Delete expired files, noting their sends to tell only the recipients
+	sends := map[string]*Send{}
 	for _, fileID := range expiredFiles {
-		err := os.Remove(filepath.Join("data", fileID))
+		sends[fileID] = sendTracker.Get(fileID)
+		err := removeEntryFile(fileID)
 		if err != nil && !os.IsNotExist(err) {
 			log.Printf("Error removing expired file %s: %v", fileID, err)
 		} else {
@@ -162,7 +228,18 @@ func (t *ExpirationTracker) CleanupExpired() []string {
 	}
 	if len(expiredFiles) > 0 {
 		t.saveToFile()
-		notifyContentChange()
+		rooms := map[string]bool{}
+		for _, fileID := range expiredFiles {
+			if _, ok := notepadNameFromID(fileID); ok {
+				publishNotepadEvent(eventNotepadExpired, fileID, "")
+				continue
+			}
+			publishEntryRemoved(eventEntryExpired, fileID, sends[fileID])
+			rooms[entryRoomKey(fileID)] = true
+		}
+		for room := range rooms {
+			notifyContentChange(room)
+		}
 	}
 	return expiredFiles
 }
@@ -208,51 +285,222 @@ func generateUniqueFilename(baseDir, baseName string) string {
 	}
 }
 
+// Streams a room's updates. Clients resuming with a Last-Event-ID header (or a
+// lastEventId parameter) first get the messages they missed
 func handleContentUpdates(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	messageChan := make(chan string)
-	clientMux.Lock()
-	clients[messageChan] = true
-	clientMux.Unlock()
-
-	defer func() {
-		clientMux.Lock()
-		delete(clients, messageChan)
-		clientMux.Unlock()
-		close(messageChan)
-	}()
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	device := deviceOwner(w, r)
+	sub, catchUp := hub.Subscribe(roomFromRequest(r).Key(), lastEventID, device, deviceTracker.Seen(device, r.UserAgent()))
+	defer hub.Unsubscribe(sub)
+	rc := http.NewResponseController(w)
+	defer rc.SetWriteDeadline(time.Time{})
+	// Gives up on clients that stop reading instead of blocking forever
+	write := func(msgs []sseMessage) error {
+		rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+		for _, msg := range msgs {
+			writeSSE(w, msg)
+		}
+		return rc.Flush()
+	}
 	ticker := time.NewTicker(20 * time.Second)
 	defer ticker.Stop()
-	// Send an initial message
-	fmt.Fprintf(w, "data: %s\n\n", "connected")
-	w.(http.Flusher).Flush()
+	if write(catchUp) != nil {
+		return
+	}
 	for {
+		var err error
 		select {
 		case <-r.Context().Done():
 			return
-		case msg := <-messageChan:
-			fmt.Fprintf(w, "data: %s\n\n", msg)
-			w.(http.Flusher).Flush()
+		case <-sub.evicted:
+			log.Printf("Dropped SSE client %s that fell behind", r.RemoteAddr)
+			return
+		case msg := <-sub.queue:
+			err = write(sub.drain(msg))
 		case <-ticker.C: // send keep-alive msg
+			rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
 			fmt.Fprintf(w, ": keep-alive\n\n")
-			w.(http.Flusher).Flush()
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
 		}
 	}
 }
 
-func notifyContentChange() {
-	clientMux.Lock()
-	defer clientMux.Unlock()
-	for client := range clients {
-		select {
-		case client <- "content_updated":
-		default:
+// Number of clients following a room's updates
+func handleSubscribers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]int{
+		"subscribers": hub.Subscribers(roomFromRequest(r).Key()),
+		"total":       hub.TotalSubscribers(),
+	})
+}
+
+// Tells the members of a room that its content changed
+func notifyContentChange(room string) {
+	hub.Publish(room, sseMessage{Data: "content_updated"})
+}
+
+// Tells one device in a room that its content changed, for entries only it sees
+func notifyDevice(room, device string) {
+	hub.Publish(room, sseMessage{Device: device, Data: "content_updated"})
+}
+
+// Builds the list of a room's snippets, files, and links from its data directory
+func listEntries(room *Room) []Entry {
+	entries := []Entry{}
+	prefix := room.Prefix()
+	// Read text snippets
+	textFiles, _ := os.ReadDir(filepath.Join("data", prefix, "text"))
+	for _, file := range textFiles {
+		if file.IsDir() {
+			continue
+		}
+		id := prefix + filepath.Join("text", file.Name())
+		data, err := readEntryContent(id)
+		if err != nil {
+			continue
+		}
+		entry := Entry{
+			ID:       id,
+			Type:     "text",
+			Content:  string(data),
+			Filename: file.Name(),
+			Size:     int64(len(data)),
+		}
+		if info, err := file.Info(); err == nil {
+			entry.Created, entry.Modified = info.ModTime(), info.ModTime()
+		}
+		entries = append(entries, entry)
+	}
+	// Read files
+	files, _ := os.ReadDir(filepath.Join("data", prefix, "files"))
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		id := prefix + filepath.Join("files", file.Name())
+		entry := Entry{
+			ID:        id,
+			Type:      "file",
+			Filename:  file.Name(),
+			Thumbnail: thumbnailURL(id),
+		}
+		if info, err := file.Info(); err == nil {
+			entry.Size = info.Size()
+			entry.Created, entry.Modified = info.ModTime(), info.ModTime()
+		}
+		if meta := metadataTracker.Get(id); meta != nil {
+			entry.Hash = meta.Hash
+			entry.Blake3 = meta.Blake3
+			if meta.Encoding != "" {
+				entry.Size = meta.Length
+			}
+		}
+		entries = append(entries, entry)
+	}
+	// Read links
+	data, err := os.ReadFile(filepath.Join("data", prefix, "links.file"))
+	if err == nil {
+		var linksModTime time.Time
+		if info, err := os.Stat(filepath.Join("data", prefix, "links.file")); err == nil {
+			linksModTime = info.ModTime()
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		for i, line := range lines {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			id := prefix + "link/" + url.QueryEscape(line)
+			// Links saved before creation times were recorded keep their order
+			// in links.file, newest last
+			saved := linksModTime.Add(time.Duration(i-len(lines)+1) * time.Millisecond)
+			entries = append(entries, Entry{
+				ID:       id,
+				Type:     "link",
+				Content:  line,
+				Filename: line,
+				Size:     int64(len(line)),
+				Created:  saved,
+				Modified: saved,
+			})
+		}
+	}
+	// Apply tags, pins, times, and expirations
+	for i := range entries {
+		if meta := metadataTracker.Get(entries[i].ID); meta != nil {
+			entries[i].Tags = meta.Tags
+			entries[i].Pinned = meta.Pinned
+			entries[i].Collection = meta.Collection
+			if !meta.Created.IsZero() {
+				entries[i].Created = meta.Created
+			}
+			if !meta.Modified.IsZero() {
+				entries[i].Modified = meta.Modified
+			}
+		}
+		if expiry, ok := expirationTracker.Get(entries[i].ID); ok {
+			entries[i].Expires = &expiry
+		}
+		if send := sendTracker.Get(entries[i].ID); send != nil {
+			entries[i].From = deviceTracker.Name(send.Sender)
+			entries[i].Pending = !send.Accepted
 		}
 	}
+	return entries
+}
+
+// Renders the home page of the request's room, or a collection's page when
+// collection is set
+func renderIndex(tmpl *template.Template, w http.ResponseWriter, r *http.Request, collection *Collection) {
+	// Clean up expired files on page load
+	expirationTracker.CleanupExpired()
+	opts, err := parseListOptions(r.URL.Query(), pageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	room := roomFromRequest(r)
+	owner := deviceOwner(w, r)
+	entries := visibleEntries(listEntries(room), owner)
+	collections := collectionCounts(room, entries)
+	basePath := room.Path() + "/"
+	if collection != nil {
+		entries = filterEntriesByCollection(entries, collection.ID)
+		basePath = room.Path() + "/collections/" + collection.ID
+	}
+	tag := r.URL.Query().Get("tag")
+	page, next := paginateEntries(filterEntriesByTag(entries, tag), opts)
+	tmpl.ExecuteTemplate(w, "index.html", IndexPage{
+		Entries:       page,
+		StripMetadata: stripMetadataDefault,
+		Usage:         currentUsage(),
+		Limits:        storageLimits,
+		Device:        deviceUsage(owner),
+		Tags:          tagCloud(entries),
+		Tag:           tag,
+		Sort:          opts.Sort,
+		Order:         opts.Order(),
+		Cursor:        r.URL.Query().Get("cursor"),
+		NextCursor:    next,
+		Collections:   collections,
+		Collection:    collection,
+		BasePath:      basePath,
+		Room:          room,
+		RoomPath:      room.Path(),
+		EventID:       hub.history.lastID(),
+	})
 }
 
 func main() {
@@ -268,11 +516,29 @@ func main() {
 		log.Fatal(err)
 	}
 	log.Println("Data directory created/reused without errors.")
+	initThumbnails()
+	initMetadataStripping()
+	initIntegrity()
+	initContentTypes()
+	initStorageLimits()
+	initDeviceQuota()
+	initCompression()
+	initPageSize()
+	initSendPickupWindow()
 	createFileIfNotExists("notepad/md.file", mdPlaceholder)
 	createFileIfNotExists("links.file", "")
 
-	// Initialize the expiration tracker
+	// Initialize the expiration tracker, entry metadata, and blob store
 	expirationTracker = initExpirationTracker()
+	metadataTracker = initMetadataTracker()
+	collectionTracker = initCollectionTracker()
+	roomTracker = initRoomTracker()
+	hub = newHub(initEventHistory())
+	deviceTracker = initDeviceTracker()
+	sendTracker = initSendTracker()
+	notepadDocs = initNotepadDocs()
+	blobStore = initBlobStore()
+	searchIndex = initSearchIndex()
 	customExpiry := os.Getenv("DEFAULT_EXPIRY")
 	if customExpiry != "" {
 		switch customExpiry {
@@ -296,69 +562,63 @@ func main() {
 		}
 	}()
 
-	tmpl := template.Must(template.ParseFS(content, "templates/*.html"))
+	tmpl := template.Must(template.New("").Funcs(template.FuncMap{
+		"formatBytes": formatBytes,
+		"asset":       assetURL,
+		"percent": func(part, total int64) int64 {
+			if total <= 0 {
+				return 0
+			}
+			return min(100, part*100/total)
+		},
+	}).ParseFS(content, "templates/*.html"))
+	// Every request goes through the rooms middleware before the routes below
+	handler := withRooms(tmpl, http.DefaultServeMux)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Clean up expired files on page load
+		renderIndex(tmpl, w, r, nil)
+	})
+
+	// JSON listing of entries for scripts and other clients. Everything is
+	// returned unless a limit is given; the next page is linked in the headers
+	http.HandleFunc("/api/entries", func(w http.ResponseWriter, r *http.Request) {
 		expirationTracker.CleanupExpired()
-		entries := []Entry{}
-		// Read text snippets
-		textFiles, _ := os.ReadDir(filepath.Join("data", "text"))
-		for _, file := range textFiles {
-			if file.IsDir() {
-				continue
-			}
-			data, err := os.ReadFile(filepath.Join("data", "text", file.Name()))
-			if err != nil {
-				continue
-			}
-			entries = append(entries, Entry{
-				ID:       filepath.Join("text", file.Name()),
-				Type:     "text",
-				Content:  string(data),
-				Filename: file.Name(),
-			})
-		}
-		// Read files
-		files, _ := os.ReadDir(filepath.Join("data", "files"))
-		for _, file := range files {
-			if file.IsDir() {
-				continue
-			}
-			entries = append(entries, Entry{
-				ID:       filepath.Join("files", file.Name()),
-				Type:     "file",
-				Filename: file.Name(),
-			})
+		opts, err := parseListOptions(r.URL.Query(), 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-		// Read links
-		data, err := os.ReadFile(filepath.Join("data", "links.file"))
-		if err == nil {
-			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
-			for _, line := range lines {
-				line = strings.TrimSpace(line)
-				if line == "" {
-					continue
-				}
-				entries = append(entries, Entry{
-					ID:       "link/" + url.QueryEscape(line),
-					Type:     "link",
-					Content:  line,
-					Filename: line,
-				})
-			}
+		room := roomFromRequest(r)
+		entries := visibleEntries(listEntries(room), deviceOwner(w, r))
+		page, next := paginateEntries(filterEntriesByTag(entries, r.URL.Query().Get("tag")), opts)
+		if next != "" {
+			query := r.URL.Query()
+			query.Set("cursor", next)
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/entries?%s>; rel="next"`, room.Path(), query.Encode()))
+			w.Header().Set("X-Next-Cursor", next)
 		}
-		tmpl.ExecuteTemplate(w, "index.html", entries)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(page)
 	})
 
-	http.HandleFunc("/md", func(w http.ResponseWriter, r *http.Request) {
-		tmpl.ExecuteTemplate(w, "md.html", nil)
-	})
+	// The default notepad at /md, and named ones at /md/<name>
+	http.HandleFunc("/md", handleNotepadPage(tmpl))
+	http.HandleFunc("/md/", handleNotepadPage(tmpl))
+
+	// Named notepads are created, renamed, deleted, and listed here
+	http.HandleFunc("/notepads", handleCreateNotepad)
+	http.HandleFunc("/notepads/", handleNotepadSettings)
+	http.HandleFunc("/api/notepads", handleNotepadList)
 
 	// Retrieve custom expiration options
 	http.HandleFunc("/getExpiryOptions", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(expirationOptions)
+		expiry := roomFromRequest(r).DefaultExpiry()
+		if collection := collectionTracker.Get(r.URL.Query().Get("collection")); collection != nil && collection.Expiry != "" {
+			expiry = collection.Expiry
+		}
+		json.NewEncoder(w).Encode(expiryOptionsWithDefault(expiry))
 	})
 
 	// Serve static files from embedded filesystem
@@ -366,123 +626,91 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create static sub-filesystem: %v", err)
 	}
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticFS))))
-
-	http.HandleFunc("/style.css", func(w http.ResponseWriter, r *http.Request) {
-		file, err := staticFS.Open("style.css")
-		if err != nil {
-			http.Error(w, "Style not found", http.StatusNotFound)
-			return
-		}
-		defer file.Close()
-		w.Header().Set("Content-Type", "text/css")
-		io.Copy(w, file)
-	})
-
-	http.HandleFunc("/manifest.json", func(w http.ResponseWriter, r *http.Request) {
-		file, err := staticFS.Open("manifest.json")
-		if err != nil {
-			http.Error(w, "Manifest not found", http.StatusNotFound)
-			return
-		}
-		defer file.Close()
-		w.Header().Set("Content-Type", "application/json")
-		io.Copy(w, file)
-	})
-
-	http.HandleFunc("/sw.js", func(w http.ResponseWriter, r *http.Request) {
-		file, err := staticFS.Open("sw.js")
-		if err != nil {
-			http.Error(w, "Service worker not found", http.StatusNotFound)
-			return
-		}
-		defer file.Close()
-		w.Header().Set("Content-Type", "application/javascript")
-		io.Copy(w, file)
-	})
+	initStaticAssets(staticFS)
+	http.HandleFunc("/static/", handleStaticAsset)
 
-	http.HandleFunc("/md.js", func(w http.ResponseWriter, r *http.Request) {
-		file, err := staticFS.Open("md.js")
-		if err != nil {
-			http.Error(w, "JavaScript not found", http.StatusNotFound)
-			return
-		}
-		defer file.Close()
-		w.Header().Set("Content-Type", "application/javascript")
-		io.Copy(w, file)
-	})
+	for _, route := range assetRoutes {
+		http.HandleFunc(route.path, assetRouteHandler(route.file, route.cacheControl))
+	}
 
-	// Handle favicon and icons
-	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
-		file, err := staticFS.Open("favicon.ico")
-		if err != nil {
-			http.Error(w, "Favicon not found", http.StatusNotFound)
+	// API endpoint to load and save a notepad's content at /notepad/<name>.file,
+	// with live editing under /notepad/<name>.file/op, /sync, and /cursor.
+	// Saves with If-Match are refused if the content no longer has that ETag
+	http.HandleFunc("/notepad/", func(w http.ResponseWriter, r *http.Request) {
+		filename, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/notepad/"), "/")
+		name, ok := strings.CutSuffix(filename, notepadFileExtension)
+		if !ok || !validNotepadName(name) {
+			http.Error(w, "Invalid notepad file", http.StatusBadRequest)
 			return
 		}
-		defer file.Close()
-		w.Header().Set("Content-Type", "image/x-icon")
-		io.Copy(w, file)
-	})
-
-	http.HandleFunc("/icon-192.png", func(w http.ResponseWriter, r *http.Request) {
-		file, err := staticFS.Open("icon-192.png")
-		if err != nil {
-			http.Error(w, "Icon not found", http.StatusNotFound)
+		id := notepadID(roomFromRequest(r), name)
+		if !notepadExists(id) {
+			http.Error(w, "Notepad not found", http.StatusNotFound)
 			return
 		}
-		defer file.Close()
-		w.Header().Set("Content-Type", "image/png")
-		io.Copy(w, file)
-	})
-
-	http.HandleFunc("/icon-512.png", func(w http.ResponseWriter, r *http.Request) {
-		file, err := staticFS.Open("icon-512.png")
-		if err != nil {
-			http.Error(w, "Icon not found", http.StatusNotFound)
+		if action != "" {
+			handleNotepadCollab(w, r, id, action)
 			return
 		}
-		defer file.Close()
-		w.Header().Set("Content-Type", "image/png")
-		io.Copy(w, file)
-	})
-
-	// API endpoint to load notepad content
-	http.HandleFunc("/notepad/", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
-			filename := strings.TrimPrefix(r.URL.Path, "/notepad/")
-			if filename != "md.file" { // && filename != "rtext.file" {
-				http.Error(w, "Invalid notepad file", http.StatusBadRequest)
-				return
-			}
-			content, err := os.ReadFile(filepath.Join("data", "notepad", filename))
+			doc, err := notepadDocs.Get(id)
 			if err != nil {
 				http.Error(w, "Error reading notepad file", http.StatusInternalServerError)
 				return
 			}
+			session, rev, content := doc.Snapshot()
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			w.Header().Set("Cache-Control", "no-store")
-			w.Write(content)
+			w.Header().Set("ETag", contentETag([]byte(content)))
+			// Where live edits continue from
+			w.Header().Set("X-Entry-ID", id)
+			w.Header().Set("X-Notepad-Session", session)
+			w.Header().Set("X-Notepad-Revision", strconv.Itoa(rev))
+			w.Write([]byte(content))
 			return
 		case "POST":
-			filename := strings.TrimPrefix(r.URL.Path, "/notepad/")
-			if filename != "md.file" { // && filename != "rtext.file" {
-				http.Error(w, "Invalid notepad file", http.StatusBadRequest)
-				return
+			if storageLimits.MaxSnippetSize > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, storageLimits.MaxSnippetSize)
 			}
 			content, err := io.ReadAll(r.Body)
-			if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeStorageError(w, fmt.Errorf("%w: the maximum is %s", errSnippetTooLarge, formatBytes(maxBytesErr.Limit)))
+				return
+			} else if err != nil {
 				http.Error(w, "Error reading request body", http.StatusInternalServerError)
 				return
 			}
-			err = os.WriteFile(filepath.Join("data", "notepad", filename), content, 0644)
+			if err := checkStorageAvailable(int64(len(content))); err != nil {
+				writeStorageError(w, err)
+				return
+			}
+			// Whole saves become an edit for anyone editing live
+			doc, err := notepadDocs.Get(id)
 			if err != nil {
-				http.Error(w, "Error saving notepad file", http.StatusInternalServerError)
+				http.Error(w, "Error reading notepad file", http.StatusInternalServerError)
 				return
 			}
+			text, ok, err := doc.Replace(string(content), r.Header.Get("If-Match"))
+			if errors.Is(err, errNotepadClosed) {
+				http.Error(w, "Notepad not found", http.StatusNotFound)
+				return
+			} else if err != nil {
+				writeStorageError(w, err)
+				return
+			} else if !ok {
+				writePreconditionFailed(w, []byte(text))
+				return
+			}
+			// The edit is live once replaced; if saving it fails now, it's
+			// tried again with the other pending edits
+			if err := doc.save(); err != nil {
+				log.Printf("Error saving notepad %s: %v", id, err)
+			}
+			w.Header().Set("ETag", contentETag([]byte(text)))
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("Saved"))
-			log.Printf("Saved notepad content to %s\n", filename)
 			return
 		}
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -493,14 +721,59 @@ func main() {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		owner := deviceOwner(w, r)
+		// Reject uploads that can't fit before reading the body
+		if err := checkStorageAvailable(max(r.ContentLength, 0)); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		if err := checkDeviceQuota(owner, r.ContentLength-multipartOverhead); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		if budget := uploadBudget(owner); budget >= 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, budget+multipartOverhead)
+		}
+		if storageLimits.MaxFileSize > 0 {
+			defer limitMultipartFiles(r, storageLimits.MaxFileSize)()
+		}
 		if err := r.ParseMultipartForm(100 << 20); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStorageError(w, err)
 			return
 		}
 		entryType := r.FormValue("type")
 		expiryOption := r.FormValue("expiry")
 		content := r.FormValue("content")
 		name := r.FormValue("name")
+		tags := parseTags(r.FormValue("tags"))
+		room := roomFromRequest(r)
+		prefix := room.Prefix()
+		var collection *Collection
+		if id := r.FormValue("collection"); id != "" {
+			if collection = collectionTracker.Get(id); collection == nil || collection.Room != room.Key() {
+				http.Error(w, "Collection not found", http.StatusNotFound)
+				return
+			}
+		}
+		// Entries added without an expiry get the collection's or room's default
+		if expiryOption == "" && collection != nil && collection.Expiry != "" {
+			expiryOption = collection.Expiry
+		} else if expiryOption == "" {
+			expiryOption = room.DefaultExpiry()
+		}
+		stripMetadata := shouldStripMetadata(r.FormValue("strip-metadata"))
+		// Files and snippets can be sent to a single device following the room
+		recipient := r.FormValue("recipient")
+		if recipient != "" {
+			if entryType == "link" {
+				http.Error(w, "Links can't be sent to a single device", http.StatusBadRequest)
+				return
+			}
+			if !deviceOnline(room.Key(), recipient) {
+				http.Error(w, "That device is not connected", http.StatusNotFound)
+				return
+			}
+		}
 		if entryType == "link" {
 			// Handle link submission
 			if content == "" {
@@ -512,7 +785,7 @@ func main() {
 				http.Error(w, "Invalid URL format. Must start with http:// or https://", http.StatusBadRequest)
 				return
 			}
-			linksFilePath := filepath.Join("data", "links.file")
+			linksFilePath := filepath.Join("data", prefix, "links.file")
 			f, err := os.OpenFile(linksFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -523,13 +796,44 @@ func main() {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			now := time.Now()
+			metadataTracker.Update(prefix+"link/"+url.QueryEscape(content), func(meta *EntryMeta) {
+				meta.Tags = tags
+				if collection != nil {
+					meta.Collection = collection.ID
+				}
+				// A duplicate of a saved link shares its entry, so keeps its creation time
+				if meta.Created.IsZero() {
+					meta.Created = now
+				}
+				meta.Modified = now
+			})
+			searchIndex.Update(prefix + "link/" + url.QueryEscape(content))
+			publishEntryEvent(eventEntryCreated, prefix+"link/"+url.QueryEscape(content))
+			w.Header().Add("X-Entry-ID", prefix+"link/"+url.QueryEscape(content))
 			log.Printf("Saved link %s\n", content)
 		} else {
 			// Handle file and text submission
 			files := r.MultipartForm.File["file-upload"]
 			if len(files) > 0 {
 				// File submission
+				var totalSize int64
 				for _, fileHeader := range files {
+					if err := checkFileSize(fileHeader.Filename, fileHeader.Size); err != nil {
+						writeStorageError(w, err)
+						return
+					}
+					totalSize += fileHeader.Size
+				}
+				if err := checkStorageAvailable(totalSize); err != nil {
+					writeStorageError(w, err)
+					return
+				}
+				if err := checkDeviceQuota(owner, totalSize); err != nil {
+					writeStorageError(w, err)
+					return
+				}
+				for i, fileHeader := range files {
 					err := func() error {
 						file, err := fileHeader.Open()
 						if err != nil {
@@ -540,54 +844,182 @@ func main() {
 						if fileName == "" {
 							fileName = fileHeader.Filename
 						}
-						uniqueFileName := generateUniqueFilename("data/files", fileName)
-						f, err := os.Create(filepath.Join("data/files", uniqueFileName))
+						uniqueFileName := generateUniqueFilename(filepath.Join("data", prefix, "files"), fileName)
+						f, err := blobStore.CreateTemp(filepath.Ext(uniqueFileName))
 						if err != nil {
 							return err
 						}
 						defer f.Close()
-						if _, err := io.Copy(f, file); err != nil {
+						// Digest while streaming so large files are only read once
+						expected := expectedDigestsFor(r, i, len(files))
+						digests := newDigestWriter(blake3Enabled || expected.blake3 != "")
+						if _, err := io.Copy(io.MultiWriter(f, digests), file); err != nil {
+							os.Remove(f.Name())
 							return err
 						}
-						if expiryOption != "Never" {
-							fileID := filepath.Join("files", uniqueFileName)
+						if err := f.Close(); err != nil {
+							os.Remove(f.Name())
+							return err
+						}
+						if err := expected.verify(digests); err != nil {
+							os.Remove(f.Name())
+							return err
+						}
+						sha256Hex, blake3Hex := digests.SHA256(), digests.BLAKE3()
+						if stripMetadata && canStripMetadata(uniqueFileName) {
+							if err := stripImageMetadata(f.Name()); err != nil {
+								log.Printf("Error stripping metadata from %s: %v", uniqueFileName, err)
+							} else {
+								// Stored content changed, so digests are recomputed from disk
+								sha256Hex = ""
+								if blake3Hex != "" {
+									if blake3Hex, err = blake3File(f.Name()); err != nil {
+										os.Remove(f.Name())
+										return err
+									}
+								}
+							}
+						}
+						var encoding string
+						var length int64
+						if compressStorage {
+							// The blob is keyed by the hash of the decoded content
+							if sha256Hex == "" {
+								if sha256Hex, err = hashFile(f.Name()); err != nil {
+									os.Remove(f.Name())
+									return err
+								}
+							}
+							if info, err := os.Stat(f.Name()); err == nil {
+								length = info.Size()
+							}
+							if encoding, err = compressUpload(f.Name(), uniqueFileName); err != nil {
+								log.Printf("Error compressing %s: %v", uniqueFileName, err)
+							}
+						}
+						fileID := prefix + filepath.Join("files", uniqueFileName)
+						// A send is recorded before its file appears, so no listing shows it to the room
+						if recipient != "" {
+							offerEntry(fileID, owner, recipient, expiryOption)
+						}
+						hash, err := blobStore.Commit(f.Name(), filepath.Join("data", fileID), sha256Hex, encoding)
+						if err != nil {
+							if recipient != "" {
+								withdrawOffer(fileID)
+							}
+							return err
+						}
+						var size int64
+						if info, err := os.Stat(filepath.Join("data", fileID)); err == nil {
+							size = info.Size()
+						}
+						now := time.Now()
+						metadataTracker.Update(fileID, func(meta *EntryMeta) {
+							meta.Created, meta.Modified = now, now
+							meta.Hash = hash
+							meta.Blake3 = blake3Hex
+							meta.Owner = owner
+							meta.Size = size
+							meta.Tags = tags
+							if collection != nil {
+								meta.Collection = collection.ID
+							}
+							meta.Encoding = encoding
+							meta.Length = 0
+							if encoding != "" {
+								meta.Length = length
+							}
+						})
+						if recipient == "" && expiryOption != "Never" {
 							expirationTracker.SetExpiration(fileID, expiryOption)
 						}
+						generateThumbnailAsync(fileID)
+						searchIndex.UpdateAsync(fileID)
+						publishEntryEvent(eventEntryCreated, fileID)
+						if recipient != "" {
+							publishSendOffered(fileID)
+						}
+						w.Header().Add("X-Entry-ID", fileID)
 						log.Printf("Saved file %s with expiry %s\n", uniqueFileName, expiryOption)
 						return nil
 					}()
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
+					if errors.Is(err, errDigestMismatch) {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					} else if err != nil {
+						writeStorageError(w, err)
 						return
 					}
 				}
 			} else if content != "" {
 				// Text snippet submission
+				if err := checkSnippetSize(len(content)); err != nil {
+					writeStorageError(w, err)
+					return
+				}
+				if err := checkStorageAvailable(int64(len(content))); err != nil {
+					writeStorageError(w, err)
+					return
+				}
+				if err := checkDeviceQuota(owner, int64(len(content))); err != nil {
+					writeStorageError(w, err)
+					return
+				}
 				filename := name
 				if filename == "" {
 					filename = time.Now().Format("Jan-02 15-04-05")
 				}
-				uniqueFileName := generateUniqueFilename("data/text", filename)
-				err := os.WriteFile(filepath.Join("data/text", uniqueFileName), []byte(content), 0644)
+				uniqueFileName := generateUniqueFilename(filepath.Join("data", prefix, "text"), filename)
+				fileID := prefix + filepath.Join("text", uniqueFileName)
+				if recipient != "" {
+					offerEntry(fileID, owner, recipient, expiryOption)
+				}
+				size, err := writeEntryContent(fileID, []byte(content))
 				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
+					if recipient != "" {
+						withdrawOffer(fileID)
+					}
+					writeStorageError(w, err)
 					return
 				}
-				if expiryOption != "Never" {
-					fileID := filepath.Join("text", uniqueFileName)
+				now := time.Now()
+				metadataTracker.Update(fileID, func(meta *EntryMeta) {
+					meta.Created, meta.Modified = now, now
+					meta.Owner = owner
+					meta.Size = size
+					meta.Tags = tags
+					if collection != nil {
+						meta.Collection = collection.ID
+					}
+				})
+				if recipient == "" && expiryOption != "Never" {
 					expirationTracker.SetExpiration(fileID, expiryOption)
 				}
+				searchIndex.Update(fileID)
+				publishEntryEvent(eventEntryCreated, fileID)
+				if recipient != "" {
+					publishSendOffered(fileID)
+				}
+				w.Header().Add("X-Entry-ID", fileID)
 				log.Printf("Saved text snippet %s with expiry %s\n", uniqueFileName, expiryOption)
 			}
 		}
-		notifyContentChange()
+		if recipient != "" {
+			notifyDevice(room.Key(), recipient)
+		} else {
+			notifyContentChange(room.Key())
+		}
 		// Send succes for AJAX
 		if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("Success"))
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		if collection != nil {
+			http.Redirect(w, r, room.Path()+"/collections/"+collection.ID, http.StatusSeeOther)
+			return
+		}
+		http.Redirect(w, r, room.Path()+"/", http.StatusSeeOther)
 	})
 
 	http.HandleFunc("/rename/", func(w http.ResponseWriter, r *http.Request) {
@@ -596,6 +1028,10 @@ func main() {
 			return
 		}
 		oldPath := strings.TrimPrefix(r.URL.Path, "/rename/")
+		if isNotepadEntry(oldPath) {
+			http.Error(w, errNotepadEntry.Error(), http.StatusBadRequest)
+			return
+		}
 		newName := r.FormValue("newname")
 		if newName == "" {
 			http.Error(w, "New name cannot be empty", http.StatusBadRequest)
@@ -607,40 +1043,57 @@ func main() {
 		// Get the new full path
 		newPath := filepath.Join(baseDir, newName)
 		oldFullPath := filepath.Join("data", oldPath)
-		// Check if there's an expiration for this file
-		expirationTracker.mu.Lock()
-		expiryTime, hasExpiry := expirationTracker.Expirations[oldPath]
-		if hasExpiry {
-			// Remove old entry and add new one
-			delete(expirationTracker.Expirations, oldPath)
-			relNewPath := strings.TrimPrefix(newPath, "data/")
-			relNewPath = strings.ReplaceAll(relNewPath, "\\", "/") // Ensure cross-platform path separators
-			expirationTracker.Expirations[relNewPath] = expiryTime
-			expirationTracker.saveToFile()
-		}
-		expirationTracker.mu.Unlock()
+		relNewPath := strings.TrimPrefix(newPath, "data/")
+		relNewPath = strings.ReplaceAll(relNewPath, "\\", "/") // Ensure cross-platform path separators
+		expirationTracker.Rename(oldPath, relNewPath)
 		// Rename the file
 		err := os.Rename(oldFullPath, newPath)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		notifyContentChange()
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		removeThumbnail(oldPath)
+		metadataTracker.Rename(oldPath, relNewPath)
+		sendTracker.Rename(oldPath, relNewPath)
+		searchIndex.Rename(oldPath, relNewPath)
+		publishEntryRenamed(oldPath, relNewPath)
+		notifyContentChange(entryRoomKey(oldPath))
+		http.Redirect(w, r, roomPath(entryRoomKey(oldPath))+"/", http.StatusSeeOther)
 		log.Printf("Renamed %s to %s\n", oldPath, newName)
 	})
 
 	http.HandleFunc("/raw/", func(w http.ResponseWriter, r *http.Request) {
 		id := strings.TrimPrefix(r.URL.Path, "/raw/")
-		if !strings.HasPrefix(id, "text/") {
+		if _, local := splitEntryID(id); !strings.HasPrefix(local, "text/") {
 			http.Error(w, "Only text files can be accessed", http.StatusBadRequest)
 			return
 		}
-		content, err := os.ReadFile(filepath.Join("data", id))
+		content, err := readEntryContent(id)
 		if err != nil {
 			http.Error(w, "File not found", 404)
 			return
 		}
+		// The ETag is that of the text, however it's stored, for If-Match on /edit/
+		w.Header().Set("ETag", contentETag(content))
+		if meta := metadataTracker.Get(id); meta != nil && meta.Encoding == "gzip" {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if acceptsGzip(r) {
+				// Pass the stored gzip stream straight through
+				data, err := os.ReadFile(filepath.Join("data", id))
+				if err != nil {
+					http.Error(w, "File not found", 404)
+					return
+				}
+				w.Header().Set("ETag", encodedETag(contentETag(content), "gzip"))
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Set("Cache-Control", "no-store")
+				w.Write(data)
+				return
+			}
+		}
+		sum := sha256.Sum256(content)
+		setDigestHeaders(w, r, hex.EncodeToString(sum[:]))
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.Header().Set("Cache-Control", "no-store")
 		w.Write(content)
@@ -648,6 +1101,10 @@ func main() {
 
 	http.HandleFunc("/download/", func(w http.ResponseWriter, r *http.Request) {
 		filename := strings.TrimPrefix(r.URL.Path, "/download/")
+		if !isEntryFile(filename) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
 		filePath := filepath.Join("data", filename)
 		fileInfo, err := os.Stat(filePath)
 		if err != nil {
@@ -661,39 +1118,25 @@ func main() {
 		}
 		defer file.Close()
 
-		// Brute force method to determine content type
-		ext := strings.ToLower(filepath.Ext(filename))
-		var contentType string
-		switch ext {
-		case ".pdf":
-			contentType = "application/pdf"
-		case ".jpg", ".jpeg":
-			contentType = "image/jpeg"
-		case ".png":
-			contentType = "image/png"
-		case ".gif":
-			contentType = "image/gif"
-		case ".svg":
-			contentType = "image/svg+xml"
-		default:
-			buffer := make([]byte, 512)
-			_, err = file.Read(buffer)
-			if err != nil && err != io.EOF {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			contentType = http.DetectContentType(buffer)
-			_, err = file.Seek(0, 0)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		meta := metadataTracker.Get(filename)
+		contentType, err := detectEntryContentType(filename, file, meta)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 		baseFilename := filepath.Base(filename)
 		w.Header().Set("Content-Type", contentType)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", baseFilename))
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", baseFilename))
 		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if meta != nil && meta.Hash != "" {
+			setDigestHeaders(w, r, meta.Hash)
+		}
+		if meta != nil && meta.Encoding != "" {
+			serveCompressedEntry(w, r, file, fileInfo, meta)
+			log.Printf("Served %s for download\n", filename)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
 		_, err = io.Copy(w, file)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -704,7 +1147,14 @@ func main() {
 
 	http.HandleFunc("/view/", func(w http.ResponseWriter, r *http.Request) {
 		filename := strings.TrimPrefix(r.URL.Path, "/view/")
-		http.ServeFile(w, r, filepath.Join("data", filename))
+		if !isEntryFile(filename) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		if meta := metadataTracker.Get(filename); meta != nil && meta.Hash != "" {
+			setDigestHeaders(w, r, meta.Hash)
+		}
+		serveFileInline(w, r, filename)
 		log.Printf("Served %s for viewing\n", filename)
 	})
 
@@ -714,42 +1164,32 @@ func main() {
 			return
 		}
 		id := strings.TrimPrefix(r.URL.Path, "/delete/")
-		// Handle link deletion
-		if strings.HasPrefix(id, "link/") {
-			linkToDelete, err := url.QueryUnescape(strings.TrimPrefix(id, "link/"))
-			if err != nil {
-				http.Error(w, "Invalid link format for deletion", http.StatusBadRequest)
+		if isNotepadEntry(id) {
+			http.Error(w, errNotepadEntry.Error(), http.StatusBadRequest)
+			return
+		}
+		// Pinned entries are only deleted with explicit confirmation
+		if metaID, err := entryIDFromPath(r, "/delete/"); err == nil {
+			if meta := metadataTracker.Get(metaID); meta != nil && meta.Pinned && r.FormValue("confirm") != "pinned" {
+				http.Error(w, "This entry is pinned; unpin it or confirm the deletion with confirm=pinned", http.StatusConflict)
 				return
 			}
-			linksFilePath := filepath.Join("data", "links.file")
-			data, err := os.ReadFile(linksFilePath)
+		}
+		// Handle link deletion
+		prefix, local := splitEntryID(id)
+		if strings.HasPrefix(local, "link/") {
+			linkToDelete, err := url.QueryUnescape(strings.TrimPrefix(local, "link/"))
 			if err != nil {
-				http.Error(w, "Failed to read links file for deletion", http.StatusInternalServerError)
+				http.Error(w, "Invalid link format for deletion", http.StatusBadRequest)
 				return
 			}
-			lines := strings.Split(string(data), "\n")
-			var newLines []string
-			var found bool
-			for _, line := range lines {
-				if strings.TrimSpace(line) == strings.TrimSpace(linkToDelete) && !found {
-					found = true // Remove only the first occurrence
-					continue
-				}
-				if strings.TrimSpace(line) != "" {
-					newLines = append(newLines, line)
-				}
-			}
-			output := strings.Join(newLines, "\n")
-			// Add newline for correctness
-			if output != "" {
-				output += "\n"
-			}
-			err = os.WriteFile(linksFilePath, []byte(output), 0644)
-			if err != nil {
-				http.Error(w, "Failed to write links file after deletion", http.StatusInternalServerError)
+			if err := removeLink(prefix, linkToDelete); err != nil {
+				log.Printf("Failed to delete link %s: %v", linkToDelete, err)
+				http.Error(w, "Failed to update links file for deletion", http.StatusInternalServerError)
 				return
 			}
-			notifyContentChange()
+			publishEntryRemoved(eventEntryDeleted, prefix+"link/"+url.QueryEscape(linkToDelete), nil)
+			notifyContentChange(entryRoomKey(id))
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte(`{"status": "ok"}`))
@@ -757,17 +1197,16 @@ func main() {
 			return
 		}
 		// Handle file and snippet deletion
-		err := os.Remove(filepath.Join("data", id))
+		send := sendTracker.Get(id)
+		err := removeEntryFile(id)
 		if err != nil {
 			log.Printf("Failed to delete %s: %v", id, err)
 			http.Error(w, "Failed to delete file", http.StatusInternalServerError)
 			return
 		}
-		expirationTracker.mu.Lock()
-		delete(expirationTracker.Expirations, id)
-		expirationTracker.saveToFile()
-		expirationTracker.mu.Unlock()
-		notifyContentChange()
+		expirationTracker.Remove(id)
+		publishEntryRemoved(eventEntryDeleted, id, send)
+		notifyContentChange(entryRoomKey(id))
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status": "ok"}`))
@@ -780,7 +1219,7 @@ func main() {
 			return
 		}
 		id := strings.TrimPrefix(r.URL.Path, "/edit/")
-		if !strings.HasPrefix(id, "text/") {
+		if _, local := splitEntryID(id); !strings.HasPrefix(local, "text/") {
 			http.Error(w, "Can only edit text snippets", http.StatusBadRequest)
 			return
 		}
@@ -789,21 +1228,204 @@ func main() {
 			http.Error(w, "Content cannot be empty", http.StatusBadRequest)
 			return
 		}
-		err := os.WriteFile(filepath.Join("data", id), []byte(content), 0644)
+		if err := checkSnippetSize(len(content)); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		if err := checkStorageAvailable(int64(len(content))); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		// Edits made with If-Match only apply to the content they were based on
+		snippetEditMu.Lock()
+		defer snippetEditMu.Unlock()
+		current, err := readEntryContent(id)
+		if !ifMatchAllows(r.Header.Get("If-Match"), contentETag(current), err == nil) {
+			writePreconditionFailed(w, current)
+			return
+		}
+		// Edits are charged to the snippet's owner, by the change in the size
+		// stored, which is compressed if the snippet will be
+		meta := metadataTracker.Get(id)
+		if meta != nil && meta.Owner != "" {
+			stored, _ := encodeEntryContent([]byte(content))
+			if err := checkDeviceQuota(meta.Owner, int64(len(stored))-meta.Size); err != nil {
+				writeStorageError(w, err)
+				return
+			}
+		}
+		// Snippets saved before creation times were recorded are dated by their file
+		var created time.Time
+		if info, err := os.Stat(filepath.Join("data", id)); err == nil {
+			created = info.ModTime()
+		}
+		size, err := writeEntryContent(id, []byte(content))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeStorageError(w, err)
 			return
 		}
-		notifyContentChange()
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		metadataTracker.Update(id, func(meta *EntryMeta) {
+			if meta.Created.IsZero() {
+				meta.Created = created
+			}
+			if meta.Owner != "" {
+				meta.Size = size
+			}
+			meta.Modified = time.Now()
+		})
+		if _, ok := r.Form["tags"]; ok {
+			setEntryTags(id, parseTags(r.FormValue("tags")))
+		}
+		searchIndex.Update(id)
+		publishEntryEvent(eventEntryUpdated, id)
+		notifyContentChange(entryRoomKey(id))
+		http.Redirect(w, r, roomPath(entryRoomKey(id))+"/", http.StatusSeeOther)
 		log.Printf("Edited %s\n", id)
 	})
 
+	// Rendered previews for text, Markdown, archives, and media files
+	http.HandleFunc("/preview/", handlePreview(tmpl))
+
+	// Cached thumbnails for image and PDF files
+	http.HandleFunc("/thumb/", handleThumbnail)
+
+	// Pinning keeps entries on top and guards them against deletion
+	http.HandleFunc("/pin/", handlePin)
+
+	// Collections group entries and can be downloaded or deleted as a whole
+	http.HandleFunc("/collections", handleCreateCollection)
+	http.HandleFunc("/collections/", handleCollection(tmpl))
+	http.HandleFunc("/api/collections", handleCollectionList)
+	http.HandleFunc("/move/", handleMoveToCollection)
+
+	// Rooms keep separate sets of entries under /r/<slug>/
+	http.HandleFunc("/rooms", handleCreateRoom)
+	http.HandleFunc("/room", handleRoomSettings)
+
+	// Full-text search over all entries
+	http.HandleFunc("/api/search", handleSearch)
+
+	// Tags on snippets, files and links
+	http.HandleFunc("/tags/", handleTags)
+	http.HandleFunc("/api/tags", handleTagList)
+
+	// Storage used by the requesting device and overall
+	http.HandleFunc("/api/usage", handleUsage)
+
 	// SSE Updates for content refresh
 	http.HandleFunc("/api/updates", handleContentUpdates)
+	http.HandleFunc("/api/subscribers", handleSubscribers)
+
+	// Devices following the updates, and the requesting device's name
+	http.HandleFunc("/api/presence", handlePresence)
+	http.HandleFunc("/api/device", handleDevice)
+
+	// The same updates over a WebSocket, which also takes commands
+	http.HandleFunc("/api/ws", handleWebSocket(handler))
+
+	// Accept or decline entries sent to this device
+	http.HandleFunc("/accept/", handleSendReply(true))
+	http.HandleFunc("/decline/", handleSendReply(false))
 
 	// Start server
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	log.Fatal(http.ListenAndServe(*listenAddress, handler))
+}
+
+// Reports whether a path under data/ is an entry's file. Only these are
+// served; the trackers, keys, blobs, and event history in data/ are not
+func isEntryFile(id string) bool {
+	if path.Clean("/"+id) != "/"+id {
+		return false
+	}
+	_, local := splitEntryID(id)
+	return strings.HasPrefix(local, "files/") || strings.HasPrefix(local, "text/") || strings.HasPrefix(local, "notepad/")
+}
+
+// Helper function to remove an entry's file along with derived data like thumbnails
+func removeEntryFile(id string) error {
+	// A notepad being edited is closed first so a pending save can't bring it back
+	notepadDocs.Close(id, false)
+	if err := os.Remove(filepath.Join("data", id)); err != nil {
+		return err
+	}
+	removeThumbnail(id)
+	searchIndex.Remove(id)
+	invalidateDataUsage()
+	if meta := metadataTracker.Delete(id); meta != nil && meta.Hash != "" {
+		blobStore.Release(blobKey(meta.Hash, meta.Encoding))
+	}
+	sendTracker.Remove(id)
+	return nil
+}
+
+// Removes the first occurrence of a link from the links.file of the room with
+// the given ID prefix
+func removeLink(prefix, link string) error {
+	linksFilePath := filepath.Join("data", prefix, "links.file")
+	data, err := os.ReadFile(linksFilePath)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	var newLines []string
+	var found bool
+	for _, line := range lines {
+		if strings.TrimSpace(line) == strings.TrimSpace(link) && !found {
+			found = true // Remove only the first occurrence
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			newLines = append(newLines, line)
+		}
+	}
+	output := strings.Join(newLines, "\n")
+	// Add newline for correctness
+	if output != "" {
+		output += "\n"
+	}
+	if err := os.WriteFile(linksFilePath, []byte(output), 0644); err != nil {
+		return err
+	}
+	// Duplicates of a link share its metadata, so keep it while one remains
+	if !slices.ContainsFunc(newLines, func(line string) bool {
+		return strings.TrimSpace(line) == strings.TrimSpace(link)
+	}) {
+		metadataTracker.Delete(prefix + "link/" + url.QueryEscape(strings.TrimSpace(link)))
+		searchIndex.Remove(prefix + "link/" + url.QueryEscape(strings.TrimSpace(link)))
+	}
+	return nil
+}
+
+// Deletes a snippet, file, or link by its entry ID
+func deleteEntry(id string) error {
+	prefix, local := splitEntryID(id)
+	if link, ok := strings.CutPrefix(local, "link/"); ok {
+		link, err := url.QueryUnescape(link)
+		if err != nil {
+			return err
+		}
+		return removeLink(prefix, link)
+	}
+	if err := removeEntryFile(id); err != nil {
+		return err
+	}
+	expirationTracker.Remove(id)
+	return nil
+}
+
+// Helper function to get the entry ID from a request path like /tags/<id>; link
+// IDs embed an escaped URL, which the decoded path has lost
+func entryIDFromPath(r *http.Request, prefix string) (string, error) {
+	escaped := strings.TrimPrefix(r.URL.EscapedPath(), prefix)
+	roomPrefix, local := splitEntryID(escaped)
+	if !strings.HasPrefix(local, "link/") {
+		return strings.TrimPrefix(r.URL.Path, prefix), nil
+	}
+	link, err := url.PathUnescape(strings.TrimPrefix(local, "link/"))
+	if err != nil {
+		return "", err
+	}
+	return roomPrefix + "link/" + url.QueryEscape(link), nil
 }
 
 // Helper function to create files if they don't exist
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Per-entry metadata keyed by entry ID (e.g. "files/report.pdf")
+type EntryMeta struct {
+	Hash       string   `json:"hash,omitempty"`   // SHA-256 of the stored blob, files only
+	Blake3     string   `json:"blake3,omitempty"` // optional BLAKE3 of the stored blob
+	Owner      string   `json:"owner,omitempty"`  // device that created the entry
+	Size       int64    `json:"size,omitempty"`   // bytes charged to the owner's quota
+	Tags       []string `json:"tags,omitempty"`
+	Pinned     bool     `json:"pinned,omitempty"`
+	Collection string   `json:"collection,omitempty"`
+	// Set when the stored body is compressed; Length is then the decoded size
+	Encoding string `json:"encoding,omitempty"`
+	Length   int64  `json:"length,omitempty"`
+	// Zero for entries saved before these were recorded
+	Created  time.Time `json:"created"`
+	Modified time.Time `json:"modified"`
+}
+
+type MetadataTracker struct {
+	Entries map[string]*EntryMeta `json:"entries"`
+	mu      sync.Mutex            // mutex for thread safety
+}
+
+var metadataTracker *MetadataTracker
+
+func initMetadataTracker() *MetadataTracker {
+	tracker := &MetadataTracker{
+		Entries: make(map[string]*EntryMeta),
+	}
+	metadataFile := filepath.Join("data", "metadata.json")
+	if data, err := os.ReadFile(metadataFile); err == nil {
+		var storedTracker MetadataTracker
+		if err := json.Unmarshal(data, &storedTracker); err == nil && storedTracker.Entries != nil {
+			tracker.Entries = storedTracker.Entries
+		}
+	}
+	return tracker
+}
+
+// Returns a copy of the metadata for an entry, or nil if it has none
+func (t *MetadataTracker) Get(id string) *EntryMeta {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	meta, ok := t.Entries[id]
+	if !ok {
+		return nil
+	}
+	metaCopy := *meta
+	metaCopy.Tags = append([]string(nil), meta.Tags...)
+	return &metaCopy
+}
+
+// Applies fn to the entry's metadata (creating it if needed) and persists it
+func (t *MetadataTracker) Update(id string, fn func(meta *EntryMeta)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	meta, ok := t.Entries[id]
+	if !ok {
+		meta = &EntryMeta{}
+		t.Entries[id] = meta
+	}
+	fn(meta)
+	t.saveToFile()
+}
+
+// Removes and returns an entry's metadata
+func (t *MetadataTracker) Delete(id string) *EntryMeta {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	meta, ok := t.Entries[id]
+	if !ok {
+		return nil
+	}
+	delete(t.Entries, id)
+	t.saveToFile()
+	return meta
+}
+
+func (t *MetadataTracker) Rename(oldID, newID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	meta, ok := t.Entries[oldID]
+	if !ok {
+		return
+	}
+	delete(t.Entries, oldID)
+	t.Entries[newID] = meta
+	t.saveToFile()
+}
+
+// Sums the bytes and entries charged to an owner
+func (t *MetadataTracker) OwnerUsage(owner string) (int64, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var used int64
+	var count int
+	for _, meta := range t.Entries {
+		if meta.Owner == owner {
+			used += meta.Size
+			count++
+		}
+	}
+	return used, count
+}
+
+func (t *MetadataTracker) saveToFile() {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		log.Printf("Error marshaling metadata: %v", err)
+		return
+	}
+	metadataFile := filepath.Join("data", "metadata.json")
+	if err := os.WriteFile(metadataFile, data, 0644); err != nil {
+		log.Printf("Error saving metadata: %v", err)
+	}
+}
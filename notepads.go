@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Besides its default notepad, a room can have any number of named ones.
+// Each is stored as notepad/<name>.file, the default being "md", and edited
+// at /md/<name>. Named notepads can be renamed, deleted, and given an expiry
+const (
+	defaultNotepad       = "md"
+	defaultNotepadTitle  = "Notepad"
+	maxNotepadNameLength = 48
+	notepadFileExtension = ".file"
+)
+
+var (
+	errNotepadExists = errors.New("a notepad with that name already exists")
+	errNotepadEntry  = errors.New("notepads are renamed and deleted at /notepads/<name>")
+)
+
+// Keeps notepads from being created, renamed, or deleted at the same time
+var notepadsMu sync.Mutex
+
+type Notepad struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Size     int64      `json:"size"`
+	Modified time.Time  `json:"modified"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// Names are lowercase letters, digits, and single dashes, as in URLs
+func validNotepadName(name string) bool {
+	return len([]rune(name)) <= maxNotepadNameLength && collectionSlug(name) == name
+}
+
+// Turns what someone typed into a notepad name, e.g. "Shopping List" into
+// "shopping-list"
+func parseNotepadName(raw string) (string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return "", fmt.Errorf("notepad name cannot be empty")
+	}
+	name := collectionSlug(raw)
+	if len([]rune(name)) > maxNotepadNameLength {
+		return "", fmt.Errorf("notepad names are limited to %d characters", maxNotepadNameLength)
+	}
+	return name, nil
+}
+
+func notepadID(room *Room, name string) string {
+	return room.Prefix() + "notepad/" + name + notepadFileExtension
+}
+
+// Returns the name of the notepad with an entry ID, if it is one
+func notepadNameFromID(id string) (string, bool) {
+	_, local := splitEntryID(id)
+	file, ok := strings.CutPrefix(local, "notepad/")
+	if !ok {
+		return "", false
+	}
+	name, ok := strings.CutSuffix(file, notepadFileExtension)
+	if !ok || !validNotepadName(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// Reports whether an entry ID lies in a room's notepad directory. Notepads
+// are renamed and deleted through /notepads/, never as ordinary entries
+func isNotepadEntry(id string) bool {
+	_, local := splitEntryID(id)
+	return strings.HasPrefix(local, "notepad/")
+}
+
+func notepadExists(id string) bool {
+	info, err := os.Stat(filepath.Join("data", id))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Lists a room's notepads, the default one first and the rest by name
+func listNotepads(room *Room) []Notepad {
+	notepads := []Notepad{}
+	files, err := os.ReadDir(filepath.Join("data", room.Prefix(), "notepad"))
+	if err != nil {
+		return notepads
+	}
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), notepadFileExtension)
+		if !ok || !validNotepadName(name) || !file.Type().IsRegular() {
+			continue
+		}
+		notepad := Notepad{ID: notepadID(room, name), Name: name}
+		if info, err := file.Info(); err == nil {
+			notepad.Size, notepad.Modified = info.Size(), info.ModTime()
+		}
+		if expiry, ok := expirationTracker.Get(notepad.ID); ok {
+			notepad.Expires = &expiry
+		}
+		notepads = append(notepads, notepad)
+	}
+	sort.Slice(notepads, func(i, j int) bool {
+		if (notepads[i].Name == defaultNotepad) != (notepads[j].Name == defaultNotepad) {
+			return notepads[i].Name == defaultNotepad
+		}
+		return notepads[i].Name < notepads[j].Name
+	})
+	return notepads
+}
+
+// Serves the editor for the default notepad at /md and named ones at /md/<name>
+func handleNotepadPage(tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := roomFromRequest(r)
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/md"), "/")
+		if name == "" {
+			name = defaultNotepad
+		}
+		if !validNotepadName(name) || !notepadExists(notepadID(room, name)) {
+			http.Error(w, "Notepad not found", http.StatusNotFound)
+			return
+		}
+		title := defaultNotepadTitle
+		if name != defaultNotepad {
+			title = name
+		}
+		tmpl.ExecuteTemplate(w, "md.html", struct {
+			RoomPath string
+			Notepad  string
+			Title    string
+			Default  bool
+		}{room.Path(), name, title, name == defaultNotepad})
+	}
+}
+
+// Lists the room's notepads
+func handleNotepadList(w http.ResponseWriter, r *http.Request) {
+	expirationTracker.CleanupExpired()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(listNotepads(roomFromRequest(r)))
+}
+
+// Creates an empty notepad from the "name" and optional "expiry" form fields
+func handleCreateNotepad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, err := parseNotepadName(r.FormValue("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expiry, err := parseExpiryOption(r.FormValue("expiry"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	room := roomFromRequest(r)
+	id := notepadID(room, name)
+	notepadsMu.Lock()
+	defer notepadsMu.Unlock()
+	file, err := os.OpenFile(filepath.Join("data", id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		http.Error(w, errNotepadExists.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error creating notepad %s: %v", id, err)
+		http.Error(w, "Error creating notepad", http.StatusInternalServerError)
+		return
+	}
+	file.Close()
+	if expiry != "" {
+		expirationTracker.SetExpiration(id, expiry)
+	}
+	searchIndex.Update(id)
+	publishNotepadEvent(eventNotepadCreated, id, "")
+	writeNotepadResponse(w, r, room, name, http.StatusCreated)
+	log.Printf("Created notepad %s\n", id)
+}
+
+// Changes or deletes a named notepad:
+//
+//	POST /notepads/<name>         rename it to "name" and/or set its "expiry"
+//	POST /notepads/<name>/delete  delete it
+func handleNotepadSettings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/notepads/"), "/")
+	room := roomFromRequest(r)
+	id := notepadID(room, name)
+	if !validNotepadName(name) || !notepadExists(id) {
+		http.Error(w, "Notepad not found", http.StatusNotFound)
+		return
+	}
+	if action != "" && action != "delete" {
+		http.NotFound(w, r)
+		return
+	}
+	if name == defaultNotepad {
+		http.Error(w, "The default notepad can't be renamed, deleted, or set to expire", http.StatusBadRequest)
+		return
+	}
+	notepadsMu.Lock()
+	defer notepadsMu.Unlock()
+	if action == "delete" {
+		if err := deleteEntry(id); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to delete %s: %v", id, err)
+			http.Error(w, "Failed to delete the notepad", http.StatusInternalServerError)
+			return
+		}
+		publishNotepadEvent(eventNotepadDeleted, id, "")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"deleted": name})
+		log.Printf("Deleted notepad %s\n", id)
+		return
+	}
+
+	// Without an expiry, the current one is kept; "Never" removes it
+	expiry, err := parseExpiryOption(r.FormValue("expiry"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	newName := name
+	if strings.TrimSpace(r.FormValue("name")) != "" {
+		if newName, err = parseNotepadName(r.FormValue("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	newID := notepadID(room, newName)
+	if newName != name {
+		if notepadExists(newID) {
+			http.Error(w, errNotepadExists.Error(), http.StatusConflict)
+			return
+		}
+		if err := renameNotepad(id, newID); err != nil {
+			log.Printf("Failed to rename %s: %v", id, err)
+			http.Error(w, "Failed to rename the notepad", http.StatusInternalServerError)
+			return
+		}
+	}
+	if strings.TrimSpace(r.FormValue("expiry")) != "" {
+		expirationTracker.SetExpiration(newID, expiry)
+	}
+	if newName != name {
+		publishNotepadEvent(eventNotepadUpdated, newID, id)
+		log.Printf("Renamed notepad %s to %s\n", id, newName)
+	} else {
+		publishNotepadEvent(eventNotepadUpdated, newID, "")
+	}
+	writeNotepadResponse(w, r, room, newName, http.StatusOK)
+}
+
+// Moves a notepad's file along with its expiry, metadata, and search entry,
+// after saving any live edits
+func renameNotepad(oldID, newID string) error {
+	if err := notepadDocs.Close(oldID, true); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join("data", oldID), filepath.Join("data", newID)); err != nil {
+		return err
+	}
+	expirationTracker.Rename(oldID, newID)
+	metadataTracker.Rename(oldID, newID)
+	searchIndex.Rename(oldID, newID)
+	return nil
+}
+
+// Answers scripts with the notepad as listed, and forms by opening it
+func writeNotepadResponse(w http.ResponseWriter, r *http.Request, room *Room, name string, status int) {
+	if r.Header.Get("X-Requested-With") != "XMLHttpRequest" {
+		http.Redirect(w, r, room.Path()+"/md/"+name, http.StatusSeeOther)
+		return
+	}
+	for _, notepad := range listNotepads(room) {
+		if notepad.Name == name {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(notepad)
+			return
+		}
+	}
+	http.Error(w, "Notepad not found", http.StatusNotFound)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func isPinned(id string) bool {
+	meta := metadataTracker.Get(id)
+	return meta != nil && meta.Pinned
+}
+
+// Sets an entry's pinned flag from the "pinned" form field, toggling it when absent
+func handlePin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := entryIDFromPath(r, "/pin/")
+	if err != nil {
+		http.Error(w, "Invalid link", http.StatusBadRequest)
+		return
+	}
+	if !entryExists(id) {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	pinned := !isPinned(id)
+	if value := r.FormValue("pinned"); value != "" {
+		if pinned, err = strconv.ParseBool(strings.ToLower(value)); err != nil {
+			http.Error(w, "pinned must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	metadataTracker.Update(id, func(meta *EntryMeta) { meta.Pinned = pinned })
+	publishEntryEvent(eventEntryUpdated, id)
+	notifyContentChange(entryRoomKey(id))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"pinned": pinned})
+	log.Printf("Set pinned for %s to %v\n", id, pinned)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Devices following a room's updates are shown as present. They are
+// identified by their device cookie, as for quotas, and named after their
+// User-Agent until they choose a name. Presence is sent as it changes in
+// presence.updated events, which are not kept for replay
+const eventPresenceUpdated = "presence.updated"
+
+// Devices that left a room are listed as offline for this long
+const presenceForgetAfter = 24 * time.Hour
+
+const maxDeviceNameLength = 40
+
+type DeviceInfo struct {
+	Name      string    `json:"name,omitempty"` // empty until the device picks one
+	UserAgent string    `json:"userAgent,omitempty"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+type DeviceTracker struct {
+	Devices map[string]*DeviceInfo `json:"devices"`
+	mu      sync.Mutex             // mutex for thread safety
+}
+
+var deviceTracker *DeviceTracker
+
+func initDeviceTracker() *DeviceTracker {
+	tracker := &DeviceTracker{
+		Devices: make(map[string]*DeviceInfo),
+	}
+	devicesFile := filepath.Join("data", "devices.json")
+	if data, err := os.ReadFile(devicesFile); err == nil {
+		var storedTracker DeviceTracker
+		if err := json.Unmarshal(data, &storedTracker); err == nil && storedTracker.Devices != nil {
+			tracker.Devices = storedTracker.Devices
+		}
+	}
+	return tracker
+}
+
+// Records a device's visit and returns its display name
+func (t *DeviceTracker) Seen(device, userAgent string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, ok := t.Devices[device]
+	if !ok {
+		info = &DeviceInfo{}
+		t.Devices[device] = info
+	}
+	info.UserAgent = userAgent
+	info.LastSeen = time.Now()
+	t.saveToFile()
+	return info.displayName()
+}
+
+func (t *DeviceTracker) Name(device string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if info, ok := t.Devices[device]; ok {
+		return info.displayName()
+	}
+	return "Unknown device"
+}
+
+// Sets a device's name; an empty name goes back to the derived one
+func (t *DeviceTracker) SetName(device, name string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, ok := t.Devices[device]
+	if !ok {
+		info = &DeviceInfo{LastSeen: time.Now()}
+		t.Devices[device] = info
+	}
+	info.Name = name
+	t.saveToFile()
+	return info.displayName()
+}
+
+func (t *DeviceTracker) saveToFile() {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		log.Printf("Error marshaling devices: %v", err)
+		return
+	}
+	devicesFile := filepath.Join("data", "devices.json")
+	if err := os.WriteFile(devicesFile, data, 0644); err != nil {
+		log.Printf("Error saving devices: %v", err)
+	}
+}
+
+func (info *DeviceInfo) displayName() string {
+	if info.Name != "" {
+		return info.Name
+	}
+	return deviceNameFromUserAgent(info.UserAgent)
+}
+
+var androidModelPattern = regexp.MustCompile(`Android [\d.]+; (?:[a-zA-Z-]+; )?([^;)]+?)(?: Build/[^;)]*)?\)`)
+
+// Makes a readable name like "Pixel 7", "iPhone", or "Firefox on Mac" from a
+// User-Agent header
+func deviceNameFromUserAgent(ua string) string {
+	switch {
+	case ua == "":
+		return "Unknown device"
+	case strings.Contains(ua, "iPhone"):
+		return "iPhone"
+	case strings.Contains(ua, "iPad"):
+		return "iPad"
+	case strings.Contains(ua, "Android"):
+		if m := androidModelPattern.FindStringSubmatch(ua); m != nil && m[1] != "K" {
+			return strings.TrimSpace(m[1])
+		}
+		return "Android device"
+	}
+	platform := ""
+	switch {
+	case strings.Contains(ua, "CrOS"):
+		platform = "Chromebook"
+	case strings.Contains(ua, "Macintosh"):
+		platform = "Mac"
+	case strings.Contains(ua, "Windows"):
+		platform = "Windows"
+	case strings.Contains(ua, "Linux"):
+		platform = "Linux"
+	}
+	browser := ""
+	switch {
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	case strings.HasPrefix(ua, "curl/"):
+		return "curl"
+	}
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case platform != "":
+		return platform
+	case browser != "":
+		return browser
+	}
+	// Scripts and other clients, e.g. "python-requests/2.31"
+	name, _, _ := strings.Cut(ua, "/")
+	return truncateRunes(name, maxDeviceNameLength)
+}
+
+func truncateRunes(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
+
+// A device's presence in a room
+type Presence struct {
+	Device      string    `json:"device"`
+	Name        string    `json:"name"`
+	Online      bool      `json:"online"`
+	Connections int       `json:"connections"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+type PresenceList struct {
+	Room    string     `json:"room,omitempty"`
+	Online  int        `json:"online"`
+	Devices []Presence `json:"devices"` // online first, then most recently seen
+}
+
+// Counts a new subscriber's connection. Reports whether its device just came
+// online. Called with h.mu held
+func (h *Hub) joinLocked(sub *subscriber) bool {
+	if h.presence[sub.room] == nil {
+		h.presence[sub.room] = make(map[string]*Presence)
+	}
+	p, ok := h.presence[sub.room][sub.device]
+	if !ok {
+		p = &Presence{Device: sub.device}
+		h.presence[sub.room][sub.device] = p
+	}
+	p.Name = sub.name
+	p.Connections++
+	p.LastSeen = time.Now()
+	p.Online = true
+	return p.Connections == 1
+}
+
+// Counts a subscriber's disconnection. Reports whether its device went
+// offline. Called with h.mu held
+func (h *Hub) leaveLocked(sub *subscriber) bool {
+	p, ok := h.presence[sub.room][sub.device]
+	if !ok {
+		return false
+	}
+	p.Connections--
+	p.LastSeen = time.Now()
+	p.Online = p.Connections > 0
+	return !p.Online
+}
+
+// Called with h.mu held
+func (h *Hub) presenceListLocked(room string) PresenceList {
+	list := PresenceList{Room: room, Devices: []Presence{}}
+	for device, p := range h.presence[room] {
+		if !p.Online && time.Since(p.LastSeen) > presenceForgetAfter {
+			delete(h.presence[room], device)
+			continue
+		}
+		if p.Online {
+			list.Online++
+		}
+		list.Devices = append(list.Devices, *p)
+	}
+	sort.Slice(list.Devices, func(i, j int) bool {
+		a, b := list.Devices[i], list.Devices[j]
+		if a.Online != b.Online {
+			return a.Online
+		}
+		if !a.Online && !a.LastSeen.Equal(b.LastSeen) {
+			return a.LastSeen.After(b.LastSeen)
+		}
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+	return list
+}
+
+// A presence.updated message for a room. Called with h.mu held
+func (h *Hub) presenceMessageLocked(room string) sseMessage {
+	data, _ := json.Marshal(h.presenceListLocked(room))
+	return sseMessage{Room: room, Event: eventPresenceUpdated, Data: string(data)}
+}
+
+func (h *Hub) Presence(room string) PresenceList {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.presenceListLocked(room)
+}
+
+// Updates a device's name in every room it's present in
+func (h *Hub) RenameDevice(device, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for room, devices := range h.presence {
+		p, ok := devices[device]
+		if !ok {
+			continue
+		}
+		p.Name = name
+		for sub := range h.rooms[room] {
+			if sub.device == device {
+				sub.name = name
+			}
+		}
+		h.sendLocked(room, h.presenceMessageLocked(room))
+	}
+}
+
+// Lists the devices in the request's room
+func handlePresence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(hub.Presence(roomFromRequest(r).Key()))
+}
+
+// Shows the requesting device's name, or changes it with the "name" form field
+func handleDevice(w http.ResponseWriter, r *http.Request) {
+	device := deviceOwner(w, r)
+	name := deviceTracker.Name(device)
+	switch r.Method {
+	case "GET":
+	case "POST":
+		name = truncateRunes(strings.Join(strings.Fields(r.FormValue("name")), " "), maxDeviceNameLength)
+		name = deviceTracker.SetName(device, name)
+		hub.RenameDevice(device, name)
+		log.Printf("Renamed device %s to %s\n", device, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"device": device, "name": name})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	previewMaxBytes     = 1 << 20 // text beyond this is truncated
+	previewMaxHighlight = 256 << 10
+	previewMaxMembers   = 5000
+)
+
+type ArchiveMember struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+	IsDir    bool
+}
+
+// Data passed to the preview.html template
+type PreviewPage struct {
+	ID        string
+	RoomPath  string
+	Filename  string
+	Kind      string // text, markdown, archive, audio or video
+	Content   string
+	Language  string
+	Highlight bool
+	Truncated bool
+	Members   []ArchiveMember
+	MoreItems bool
+}
+
+// Escapes each segment of an entry ID for use in a URL path
+func escapeEntryPath(id string) string {
+	segments := strings.Split(id, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Picks how a file is previewed, or "" to hand it to the browser via /view/
+func previewKind(id, ctype string) string {
+	mediaType, _, _ := mime.ParseMediaType(ctype)
+	name := strings.ToLower(id)
+	switch {
+	case strings.HasSuffix(name, ".md") || strings.HasSuffix(name, ".markdown") || mediaType == "text/markdown":
+		return "markdown"
+	case mediaType == "application/zip" || mediaType == "application/epub+zip":
+		return "zip"
+	case mediaType == "application/x-tar" || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		return "tar"
+	case strings.HasPrefix(mediaType, "audio/"):
+		return "audio"
+	case strings.HasPrefix(mediaType, "video/"):
+		return "video"
+	case strings.HasPrefix(mediaType, "text/"), mediaType == "application/json", mediaType == "application/yaml",
+		mediaType == "application/toml", isActiveContentType(ctype):
+		return "text"
+	}
+	return ""
+}
+
+func handlePreview(tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/preview/")
+		if _, local := splitEntryID(id); !strings.HasPrefix(local, "files/") {
+			http.Error(w, "Only files can be previewed", http.StatusBadRequest)
+			return
+		}
+		filePath := filepath.Join("data", id)
+		file, err := os.Open(filePath)
+		if err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		defer file.Close()
+		meta := metadataTracker.Get(id)
+		ctype, err := detectEntryContentType(id, file, meta)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		kind := previewKind(id, ctype)
+		if member := r.URL.Query().Get("member"); member != "" && (kind == "zip" || kind == "tar") {
+			extractArchiveMember(w, file, filePath, kind, member)
+			return
+		}
+		page := PreviewPage{ID: id, RoomPath: roomPath(entryRoomKey(id)), Filename: filepath.Base(id), Kind: kind}
+		switch kind {
+		case "text", "markdown":
+			src, err := decodedReader(file, meta)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			data, err := io.ReadAll(io.LimitReader(src, previewMaxBytes+1))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(data) > previewMaxBytes {
+				data, page.Truncated = data[:previewMaxBytes], true
+			}
+			// Binary files with a text-like extension go straight to the browser
+			if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(trimPartialRune(data)) {
+				http.Redirect(w, r, "/view/"+escapeEntryPath(id), http.StatusSeeOther)
+				return
+			}
+			page.Content = string(data)
+			page.Language = strings.TrimPrefix(strings.ToLower(filepath.Ext(id)), ".")
+			page.Highlight = len(data) <= previewMaxHighlight
+		case "zip":
+			page.Kind = "archive"
+			page.Members, page.MoreItems, err = listZipMembers(filePath)
+		case "tar":
+			page.Kind = "archive"
+			page.Members, page.MoreItems, err = listTarMembers(file, filePath)
+		case "audio", "video":
+		default:
+			http.Redirect(w, r, "/view/"+escapeEntryPath(id), http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			log.Printf("Error reading archive %s: %v", id, err)
+			http.Error(w, "Could not read archive", http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		tmpl.ExecuteTemplate(w, "preview.html", page)
+		log.Printf("Served %s for preview\n", id)
+	}
+}
+
+// Drops an incomplete UTF-8 sequence left at the end by truncation
+func trimPartialRune(data []byte) []byte {
+	for i := 0; i < utf8.UTFMax && len(data) > 0; i++ {
+		if r, size := utf8.DecodeLastRune(data); r != utf8.RuneError || size != 1 {
+			break
+		}
+		data = data[:len(data)-1]
+	}
+	return data
+}
+
+func listZipMembers(filePath string) ([]ArchiveMember, bool, error) {
+	zr, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	defer zr.Close()
+	var members []ArchiveMember
+	for _, f := range zr.File {
+		if len(members) == previewMaxMembers {
+			return members, true, nil
+		}
+		members = append(members, ArchiveMember{
+			Name:     f.Name,
+			Size:     int64(f.UncompressedSize64),
+			Modified: f.Modified,
+			IsDir:    f.FileInfo().IsDir(),
+		})
+	}
+	return members, false, nil
+}
+
+// Returns a tar reader, transparently handling gzip-compressed archives
+func openTar(file *os.File, filePath string) (*tar.Reader, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(filePath)
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, err
+		}
+		return tar.NewReader(gz), nil
+	}
+	return tar.NewReader(file), nil
+}
+
+func listTarMembers(file *os.File, filePath string) ([]ArchiveMember, bool, error) {
+	tr, err := openTar(file, filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	var members []ArchiveMember
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return members, false, nil
+		}
+		if err != nil {
+			return members, false, err
+		}
+		if len(members) == previewMaxMembers {
+			return members, true, nil
+		}
+		members = append(members, ArchiveMember{
+			Name:     hdr.Name,
+			Size:     hdr.Size,
+			Modified: hdr.ModTime,
+			IsDir:    hdr.Typeflag == tar.TypeDir,
+		})
+	}
+}
+
+// Streams a single archive member to the client as a download
+func extractArchiveMember(w http.ResponseWriter, file *os.File, filePath, kind, member string) {
+	var src io.Reader
+	var size int64 = -1
+	switch kind {
+	case "zip":
+		zr, err := zip.OpenReader(filePath)
+		if err != nil {
+			http.Error(w, "Could not read archive", http.StatusUnprocessableEntity)
+			return
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if f.Name == member && !f.FileInfo().IsDir() {
+				rc, err := f.Open()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+					return
+				}
+				defer rc.Close()
+				src, size = rc, int64(f.UncompressedSize64)
+				break
+			}
+		}
+	case "tar":
+		tr, err := openTar(file, filePath)
+		if err != nil {
+			http.Error(w, "Could not read archive", http.StatusUnprocessableEntity)
+			return
+		}
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			if hdr.Name == member && hdr.Typeflag == tar.TypeReg {
+				src, size = tr, hdr.Size
+				break
+			}
+		}
+	}
+	if src == nil {
+		http.Error(w, "Archive member not found", http.StatusNotFound)
+		return
+	}
+	base := path.Base(member)
+	w.Header().Set("Content-Type", contentTypeByName(base))
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", base))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		log.Printf("Error extracting %s from %s: %v", member, filePath, err)
+		return
+	}
+	log.Printf("Extracted %s from %s\n", member, filePath)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Entries are attributed to the device that created them through a long-lived
+// random cookie; DEVICE_QUOTA caps how much each device may store
+const deviceCookieName = "lcs_device"
+
+var deviceQuota int64
+
+var errQuotaExceeded = errors.New("device quota exceeded")
+
+type DeviceUsage struct {
+	Device  string `json:"device"`
+	Used    int64  `json:"used"`
+	Quota   int64  `json:"quota"` // 0 means unlimited
+	Entries int    `json:"entries"`
+}
+
+func initDeviceQuota() {
+	raw := os.Getenv("DEVICE_QUOTA")
+	if raw == "" {
+		return
+	}
+	size, err := parseByteSize(raw)
+	if err != nil {
+		log.Fatalf("Invalid DEVICE_QUOTA value %q: %v", raw, err)
+	}
+	deviceQuota = size
+	log.Printf("DEVICE_QUOTA set to %s", formatBytes(size))
+}
+
+// Returns the owner ID for the requesting device, issuing a cookie on first visit.
+// Only a hash of the cookie is stored, so metadata.json can't be used to impersonate a device
+func deviceOwner(w http.ResponseWriter, r *http.Request) string {
+	token := ""
+	if c, err := r.Cookie(deviceCookieName); err == nil && len(c.Value) == 32 {
+		if _, err := hex.DecodeString(c.Value); err == nil {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		buf := make([]byte, 16)
+		rand.Read(buf)
+		token = hex.EncodeToString(buf)
+		http.SetCookie(w, &http.Cookie{
+			Name:     deviceCookieName,
+			Value:    token,
+			Path:     "/",
+			MaxAge:   int((10 * 365 * 24 * time.Hour).Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+func deviceUsage(owner string) DeviceUsage {
+	used, count := metadataTracker.OwnerUsage(owner)
+	return DeviceUsage{Device: owner, Used: used, Quota: deviceQuota, Entries: count}
+}
+
+// Checks that an owner can store n more bytes; shrinking edits (n <= 0) always pass
+func checkDeviceQuota(owner string, n int64) error {
+	if deviceQuota <= 0 || owner == "" || n <= 0 {
+		return nil
+	}
+	if used, _ := metadataTracker.OwnerUsage(owner); used+n > deviceQuota {
+		return fmt.Errorf("%w: %s of %s already used by this device", errQuotaExceeded, formatBytes(used), formatBytes(deviceQuota))
+	}
+	return nil
+}
+
+// Returns how many more bytes an upload from owner may contain, or -1 if unlimited
+func uploadBudget(owner string) int64 {
+	budget := storageBudget()
+	if deviceQuota > 0 && owner != "" {
+		used, _ := metadataTracker.OwnerUsage(owner)
+		remaining := max(0, deviceQuota-used)
+		if budget < 0 || remaining < budget {
+			budget = remaining
+		}
+	}
+	return budget
+}
+
+// Reports the requesting device's quota usage alongside overall storage
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	expirationTracker.CleanupExpired()
+	owner := deviceOwner(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Device  DeviceUsage  `json:"device"`
+		Storage StorageUsage `json:"storage"`
+	}{deviceUsage(owner), currentUsage()})
+}
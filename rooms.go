@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rooms are separate namespaces, each with its own snippets, files, links,
+// notepad, collections, default expiry, and live updates. A room's content is
+// stored in data/rooms/<slug> and its entry IDs carry the "rooms/<slug>/"
+// prefix, so the metadata, expiration, and search trackers handle them as they
+// are. Rooms are reached at /r/<slug>/ and can be protected by a code; entries
+// outside any room make up the default room at /
+type Room struct {
+	Slug     string    `json:"slug"`
+	Name     string    `json:"name"`
+	Expiry   string    `json:"expiry,omitempty"` // default expiry option for new entries
+	CodeSalt string    `json:"codeSalt,omitempty"`
+	CodeHash string    `json:"codeHash,omitempty"` // empty for open rooms
+	Created  time.Time `json:"created"`
+}
+
+type RoomTracker struct {
+	Rooms map[string]*Room `json:"rooms"`
+	mu    sync.Mutex       // mutex for thread safety
+}
+
+const roomCookiePrefix = "lcs_room_"
+
+var roomTracker *RoomTracker
+
+// Signs room access cookies. It is made at random on first start and kept in
+// data/room-access.key, which like the other non-entry files is never served
+var roomAccessKey []byte
+
+var (
+	roomSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,47}$`)
+	errRoomExists   = errors.New("a room with that name already exists")
+)
+
+func initRoomTracker() *RoomTracker {
+	tracker := &RoomTracker{
+		Rooms: make(map[string]*Room),
+	}
+	roomsFile := filepath.Join("data", "rooms.json")
+	if data, err := os.ReadFile(roomsFile); err == nil {
+		var storedTracker RoomTracker
+		if err := json.Unmarshal(data, &storedTracker); err == nil && storedTracker.Rooms != nil {
+			tracker.Rooms = storedTracker.Rooms
+		}
+	}
+	for _, room := range tracker.Rooms {
+		ensureRoomDirs(room)
+	}
+	roomAccessKey = loadRoomAccessKey()
+	return tracker
+}
+
+func loadRoomAccessKey() []byte {
+	keyFile := filepath.Join("data", "room-access.key")
+	if key, err := os.ReadFile(keyFile); err == nil && len(key) == 32 {
+		return key
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		log.Printf("Error saving room access key, codes must be entered again after a restart: %v", err)
+	}
+	return key
+}
+
+// Returns a copy of a room, or nil if it doesn't exist
+func (t *RoomTracker) Get(slug string) *Room {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	room, ok := t.Rooms[slug]
+	if !ok {
+		return nil
+	}
+	roomCopy := *room
+	return &roomCopy
+}
+
+func (t *RoomTracker) List() []Room {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rooms := make([]Room, 0, len(t.Rooms))
+	for _, room := range t.Rooms {
+		rooms = append(rooms, *room)
+	}
+	return rooms
+}
+
+func (t *RoomTracker) Create(room *Room) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.Rooms[room.Slug]; ok {
+		return errRoomExists
+	}
+	if err := ensureRoomDirs(room); err != nil {
+		return err
+	}
+	t.Rooms[room.Slug] = room
+	t.saveToFile()
+	return nil
+}
+
+func (t *RoomTracker) Update(slug string, fn func(room *Room)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if room, ok := t.Rooms[slug]; ok {
+		fn(room)
+		t.saveToFile()
+	}
+}
+
+func (t *RoomTracker) saveToFile() {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		log.Printf("Error marshaling rooms: %v", err)
+		return
+	}
+	roomsFile := filepath.Join("data", "rooms.json")
+	if err := os.WriteFile(roomsFile, data, 0600); err != nil {
+		log.Printf("Error saving rooms: %v", err)
+	}
+}
+
+// The prefix of the room's entry IDs, "" for the default room
+func (room *Room) Prefix() string {
+	if room == nil {
+		return ""
+	}
+	return "rooms/" + room.Slug + "/"
+}
+
+// The prefix of the room's URLs, "" for the default room
+func (room *Room) Path() string {
+	if room == nil {
+		return ""
+	}
+	return "/r/" + room.Slug
+}
+
+// The room's slug, "" for the default room
+func (room *Room) Key() string {
+	if room == nil {
+		return ""
+	}
+	return room.Slug
+}
+
+// Default expiry option for new entries, "" when none is set
+func (room *Room) DefaultExpiry() string {
+	if room == nil {
+		return ""
+	}
+	return room.Expiry
+}
+
+func (room *Room) Protected() bool {
+	return room != nil && room.CodeHash != ""
+}
+
+func ensureRoomDirs(room *Room) error {
+	for _, dir := range []string{"text", "files", "notepad"} {
+		if err := os.MkdirAll(filepath.Join("data", room.Prefix(), dir), 0755); err != nil {
+			return err
+		}
+	}
+	createFileIfNotExists(room.Prefix()+"notepad/md.file", mdPlaceholder)
+	createFileIfNotExists(room.Prefix()+"links.file", "")
+	return nil
+}
+
+// Splits an entry ID into its room prefix ("" or "rooms/<slug>/") and the ID
+// within the room, e.g. "text/notes.txt"
+func splitEntryID(id string) (string, string) {
+	rest, ok := strings.CutPrefix(id, "rooms/")
+	if !ok {
+		return "", id
+	}
+	slug, local, ok := strings.Cut(rest, "/")
+	if !ok {
+		return "", id
+	}
+	return "rooms/" + slug + "/", local
+}
+
+// The slug of the room an entry belongs to, "" for the default room
+func entryRoomKey(id string) string {
+	prefix, _ := splitEntryID(id)
+	return strings.TrimSuffix(strings.TrimPrefix(prefix, "rooms/"), "/")
+}
+
+// The room an entry belongs to; ok is false if that room doesn't exist
+func entryRoom(id string) (room *Room, ok bool) {
+	key := entryRoomKey(id)
+	if key == "" {
+		return nil, true
+	}
+	room = roomTracker.Get(key)
+	return room, room != nil
+}
+
+type roomContextKey struct{}
+
+// Returns the room a request was made in, nil for the default room
+func roomFromRequest(r *http.Request) *Room {
+	room, _ := r.Context().Value(roomContextKey{}).(*Room)
+	return room
+}
+
+func hashRoomCode(salt, code string) string {
+	sum := sha256.Sum256([]byte(salt + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// The value of the cookie granting access to a protected room, signed with
+// the server's key. It covers the code's hash, so changing the code signs
+// everyone out
+func roomAccessToken(room *Room) string {
+	mac := hmac.New(sha256.New, roomAccessKey)
+	mac.Write([]byte("room-access:" + room.Slug + ":" + room.CodeHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func hasRoomAccess(r *http.Request, room *Room) bool {
+	if !room.Protected() {
+		return true
+	}
+	c, err := r.Cookie(roomCookiePrefix + room.Slug)
+	return err == nil && subtle.ConstantTimeCompare([]byte(c.Value), []byte(roomAccessToken(room))) == 1
+}
+
+func grantRoomAccess(w http.ResponseWriter, room *Room) {
+	if !room.Protected() {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     roomCookiePrefix + room.Slug,
+		Value:    roomAccessToken(room),
+		Path:     "/", // entry URLs such as /download/rooms/<slug>/... live outside /r/
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func setRoomCode(room *Room, code string) {
+	if code == "" {
+		room.CodeSalt, room.CodeHash = "", ""
+		return
+	}
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	room.CodeSalt = hex.EncodeToString(salt)
+	room.CodeHash = hashRoomCode(room.CodeSalt, code)
+}
+
+// Validates a default expiry option from a form; "Never" and "" mean none
+func parseExpiryOption(expiry string) (string, error) {
+	expiry = strings.TrimSpace(expiry)
+	switch expiry {
+	case "Never":
+		return "", nil
+	case "", "1 hour", "4 hours", "1 day":
+		return expiry, nil
+	}
+	if !customExpiryPattern.MatchString(expiry) {
+		return "", fmt.Errorf("invalid expiry %q, use 1 hour, 4 hours, 1 day, Never, or a value like 3d", expiry)
+	}
+	return expiry, nil
+}
+
+// Expiry options with the given default, if any, first
+func expiryOptionsWithDefault(expiry string) []string {
+	if expiry == "" {
+		return expirationOptions
+	}
+	options := []string{expiry}
+	for _, option := range expirationOptions {
+		if option != expiry {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// Routes /r/<slug>/... to the regular handlers with the room in the request's
+// context, and checks access to protected rooms, both there and on entry URLs
+// like /download/rooms/<slug>/files/report.pdf
+func withRooms(tmpl *template.Template, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+		if parts[0] != "r" || len(parts) < 2 {
+			if checkEntryRoomAccess(w, r) && checkEntryRecipient(w, r) {
+				next.ServeHTTP(w, r)
+			}
+			return
+		}
+		room := roomTracker.Get(parts[1])
+		if room == nil {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		if len(parts) == 2 {
+			http.Redirect(w, r, room.Path()+"/", http.StatusMovedPermanently)
+			return
+		}
+		rest := "/" + parts[2]
+		if rest == "/enter" {
+			handleRoomEnter(tmpl, w, r, room)
+			return
+		}
+		if !hasRoomAccess(r, room) {
+			if rest == "/" && r.Method == "GET" {
+				renderRoomCodePage(tmpl, w, room, "")
+				return
+			}
+			http.Error(w, "This room requires a code", http.StatusForbidden)
+			return
+		}
+		r2 := r.WithContext(context.WithValue(r.Context(), roomContextKey{}, room))
+		r2.URL.Path = rest
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, room.Path())
+		if checkEntryRoomAccess(w, r2) && checkEntryRecipient(w, r2) {
+			next.ServeHTTP(w, r2)
+		}
+	})
+}
+
+// Checks access to the room of an entry named in a path like
+// /download/rooms/<slug>/files/report.pdf, writing an error if it's denied
+func checkEntryRoomAccess(w http.ResponseWriter, r *http.Request) bool {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 4)
+	if len(parts) < 3 || parts[1] != "rooms" {
+		return true
+	}
+	room := roomTracker.Get(parts[2])
+	if room == nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return false
+	}
+	if !hasRoomAccess(r, room) {
+		http.Error(w, "This room requires a code", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func renderRoomCodePage(tmpl *template.Template, w http.ResponseWriter, room *Room, message string) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	tmpl.ExecuteTemplate(w, "room.html", struct {
+		Room  *Room
+		Error string
+	}{room, message})
+}
+
+// Checks a room's code and grants access to it
+func handleRoomEnter(tmpl *template.Template, w http.ResponseWriter, r *http.Request, room *Room) {
+	if r.Method != "POST" {
+		http.Redirect(w, r, room.Path()+"/", http.StatusSeeOther)
+		return
+	}
+	code := r.FormValue("code")
+	if room.Protected() && subtle.ConstantTimeCompare([]byte(hashRoomCode(room.CodeSalt, code)), []byte(room.CodeHash)) != 1 {
+		log.Printf("Wrong code entered for room %s\n", room.Slug)
+		time.Sleep(time.Second) // slow down guessing
+		renderRoomCodePage(tmpl, w, room, "That code is not right.")
+		return
+	}
+	grantRoomAccess(w, room)
+	http.Redirect(w, r, room.Path()+"/", http.StatusSeeOther)
+}
+
+// Creates a room from the "name" form field, with an optional "slug" for its
+// URL, "code" to protect it, and default "expiry"
+func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.Join(strings.Fields(r.FormValue("name")), " ")
+	if name == "" {
+		http.Error(w, "Room name cannot be empty", http.StatusBadRequest)
+		return
+	}
+	slug := strings.ToLower(strings.TrimSpace(r.FormValue("slug")))
+	if slug == "" {
+		slug = collectionSlug(name)
+	}
+	if !roomSlugPattern.MatchString(slug) {
+		http.Error(w, "Room URLs may only use lowercase letters, digits, and dashes (up to 48)", http.StatusBadRequest)
+		return
+	}
+	expiry, err := parseExpiryOption(r.FormValue("expiry"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	room := &Room{Slug: slug, Name: name, Expiry: expiry, Created: time.Now()}
+	setRoomCode(room, r.FormValue("code"))
+	if err := roomTracker.Create(room); errors.Is(err, errRoomExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to create the room", http.StatusInternalServerError)
+		log.Printf("Error creating room %s: %v", slug, err)
+		return
+	}
+	grantRoomAccess(w, room)
+	http.Redirect(w, r, room.Path()+"/", http.StatusSeeOther)
+	log.Printf("Created room %s\n", slug)
+}
+
+// Shows the current room's settings, or changes its name, default expiry, or
+// code (an empty "code" with clear-code=true removes it)
+func handleRoomSettings(w http.ResponseWriter, r *http.Request) {
+	room := roomFromRequest(r)
+	if room == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"slug": room.Slug, "name": room.Name, "expiry": room.Expiry, "protected": room.Protected(),
+		})
+	case "POST":
+		name := strings.Join(strings.Fields(r.FormValue("name")), " ")
+		expiry, err := parseExpiryOption(r.FormValue("expiry"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		code := r.FormValue("code")
+		roomTracker.Update(room.Slug, func(room *Room) {
+			if name != "" {
+				room.Name = name
+			}
+			room.Expiry = expiry
+			if code != "" || r.FormValue("clear-code") == "true" {
+				setRoomCode(room, code)
+			}
+		})
+		grantRoomAccess(w, roomTracker.Get(room.Slug))
+		notifyContentChange(room.Key())
+		http.Redirect(w, r, room.Path()+"/", http.StatusSeeOther)
+		log.Printf("Updated room %s\n", room.Slug)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// The prefix of the URLs of the room with the given slug
+func roomPath(key string) string {
+	if key == "" {
+		return ""
+	}
+	return "/r/" + key
+}
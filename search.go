@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// In-memory inverted index over snippets, the notepad, links, file names and
+// the text of plain-text and PDF uploads. It's built in the background at
+// startup and updated whenever an entry changes
+const (
+	searchMaxIndexed  = 4 << 20  // text beyond this isn't indexed
+	searchMaxStored   = 64 << 10 // text kept per document for excerpts
+	searchTitleWeight = 3        // a title match counts as this many body matches
+	searchExcerptLen  = 160
+)
+
+type searchDoc struct {
+	ID     string
+	Type   string // text, file, link or notepad
+	Title  string
+	Tags   []string
+	Text   string // start of the body, for excerpts
+	Length int    // weighted number of terms
+	terms  []string
+}
+
+type SearchIndex struct {
+	docs     map[string]*searchDoc
+	postings map[string]map[string]int // term -> doc ID -> weighted frequency
+	pending  map[string]uint64         // doc ID -> ticket of its latest update in progress
+	tickets  uint64
+	mu       sync.RWMutex
+}
+
+type SearchResult struct {
+	ID      string   `json:"id"`
+	Type    string   `json:"type"`
+	Title   string   `json:"title"`
+	Tags    []string `json:"tags,omitempty"`
+	Score   float64  `json:"score"`
+	Excerpt string   `json:"excerpt"` // HTML-escaped, matches wrapped in <mark>
+}
+
+var (
+	searchIndex   *SearchIndex
+	pdftotextPath string // empty when poppler is not installed
+)
+
+func initSearchIndex() *SearchIndex {
+	index := &SearchIndex{
+		docs:     make(map[string]*searchDoc),
+		postings: make(map[string]map[string]int),
+		pending:  make(map[string]uint64),
+	}
+	if path, err := exec.LookPath("pdftotext"); err == nil {
+		pdftotextPath = path
+	}
+	go index.rebuild()
+	return index
+}
+
+// Indexes every existing entry; PDFs make this slow enough to keep off the startup path
+func (s *SearchIndex) rebuild() {
+	start := time.Now()
+	rooms := []*Room{nil}
+	for _, room := range roomTracker.List() {
+		rooms = append(rooms, &room)
+	}
+	for _, room := range rooms {
+		for _, notepad := range listNotepads(room) {
+			s.Update(notepad.ID)
+		}
+		for _, entry := range listEntries(room) {
+			s.Update(entry.ID)
+		}
+	}
+	s.mu.RLock()
+	count := len(s.docs)
+	s.mu.RUnlock()
+	log.Printf("Indexed %d entries for search in %v", count, time.Since(start).Round(time.Millisecond))
+}
+
+// A token's byte span within the text it came from
+type searchToken struct {
+	term       string
+	start, end int
+}
+
+// Splits text into lowercase runs of letters and digits
+func tokenize(text string) []searchToken {
+	var tokens []searchToken
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = appendToken(tokens, text, start, i)
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = appendToken(tokens, text, start, len(text))
+	}
+	return tokens
+}
+
+func appendToken(tokens []searchToken, text string, start, end int) []searchToken {
+	if end-start > 64 {
+		return tokens // hashes, base64 and the like
+	}
+	return append(tokens, searchToken{term: strings.ToLower(text[start:end]), start: start, end: end})
+}
+
+// Loads the searchable title and body for an entry, or nil if it's gone
+func loadSearchDoc(id string) *searchDoc {
+	doc := &searchDoc{ID: id, Tags: entryTags(id)}
+	_, local := splitEntryID(id)
+	notepad, isNotepad := notepadNameFromID(id)
+	switch {
+	case isNotepad:
+		data, err := readEntryContent(id)
+		if err != nil {
+			return nil
+		}
+		doc.Type, doc.Title, doc.Text = "notepad", notepad, string(data)
+		if notepad == defaultNotepad {
+			doc.Title = defaultNotepadTitle
+		}
+	case strings.HasPrefix(local, "text/"):
+		data, err := readEntryContent(id)
+		if err != nil {
+			return nil
+		}
+		doc.Type, doc.Title, doc.Text = "text", filepath.Base(id), string(data)
+	case strings.HasPrefix(local, "link/"):
+		link, err := url.QueryUnescape(strings.TrimPrefix(local, "link/"))
+		if err != nil || !entryExists(id) {
+			return nil
+		}
+		doc.Type, doc.Title, doc.Text = "link", link, link
+	case strings.HasPrefix(local, "files/"):
+		if _, err := os.Stat(filepath.Join("data", id)); err != nil {
+			return nil
+		}
+		doc.Type, doc.Title = "file", filepath.Base(id)
+		text, err := extractFileText(id)
+		if err != nil {
+			log.Printf("Error extracting text from %s for search: %v", id, err)
+		}
+		doc.Text = text
+	default:
+		return nil
+	}
+	if len(doc.Text) > searchMaxIndexed {
+		doc.Text = string(trimPartialRune([]byte(doc.Text[:searchMaxIndexed])))
+	}
+	return doc
+}
+
+// Returns the text of plain-text and PDF uploads, and "" for anything else
+func extractFileText(id string) (string, error) {
+	file, err := os.Open(filepath.Join("data", id))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	meta := metadataTracker.Get(id)
+	ctype, err := detectEntryContentType(id, file, meta)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(ctype, "application/pdf") {
+		return extractPDFText(filepath.Join("data", id))
+	}
+	if !isCompressibleType(ctype) {
+		return "", nil
+	}
+	src, err := decodedReader(file, meta)
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(io.LimitReader(src, searchMaxIndexed))
+	if err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(trimPartialRune(data)) {
+		return "", nil
+	}
+	return string(data), nil
+}
+
+// Extracts a PDF's text layer with poppler's pdftotext
+func extractPDFText(path string) (string, error) {
+	if pdftotextPath == "" {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, pdftotextPath, "-enc", "UTF-8", "-q", path, "-")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+	return strings.ToValidUTF8(out.String(), ""), nil
+}
+
+// Re-reads an entry from disk and replaces its index entry, or drops it if the
+// entry is gone. Reading can be slow, so the result is only kept if no later
+// update or removal of the entry came in meanwhile
+func (s *SearchIndex) Update(id string) {
+	s.mu.Lock()
+	s.tickets++
+	ticket := s.tickets
+	s.pending[id] = ticket
+	s.mu.Unlock()
+
+	doc := loadSearchDoc(id)
+	if doc == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.pending[id] == ticket {
+			delete(s.pending, id)
+			s.removeLocked(id)
+		}
+		return
+	}
+	freqs := map[string]int{}
+	for _, token := range tokenize(doc.Title + " " + strings.Join(doc.Tags, " ")) {
+		freqs[token.term] += searchTitleWeight
+	}
+	for _, token := range tokenize(doc.Text) {
+		freqs[token.term]++
+	}
+	for term, freq := range freqs {
+		doc.Length += freq
+		doc.terms = append(doc.terms, term)
+	}
+	if len(doc.Text) > searchMaxStored {
+		doc.Text = string(trimPartialRune([]byte(doc.Text[:searchMaxStored])))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending[id] != ticket {
+		return
+	}
+	delete(s.pending, id)
+	s.removeLocked(id)
+	s.docs[id] = doc
+	for term, freq := range freqs {
+		if s.postings[term] == nil {
+			s.postings[term] = make(map[string]int)
+		}
+		s.postings[term][id] = freq
+	}
+}
+
+// Indexes an entry in the background, for callers that shouldn't wait on PDF extraction
+func (s *SearchIndex) UpdateAsync(id string) {
+	go s.Update(id)
+}
+
+// Drops an entry, including from any update still reading it
+func (s *SearchIndex) Remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, id)
+	s.removeLocked(id)
+}
+
+func (s *SearchIndex) removeLocked(id string) {
+	doc, ok := s.docs[id]
+	if !ok {
+		return
+	}
+	delete(s.docs, id)
+	for _, term := range doc.terms {
+		delete(s.postings[term], id)
+		if len(s.postings[term]) == 0 {
+			delete(s.postings, term)
+		}
+	}
+}
+
+func (s *SearchIndex) Rename(oldID, newID string) {
+	s.Remove(oldID)
+	s.UpdateAsync(newID)
+}
+
+// Ranks documents containing every query term with BM25. The last term also
+// matches as a prefix so results appear while the query is being typed
+func (s *SearchIndex) Search(query string, limit int) []SearchResult {
+	var terms []string
+	for _, token := range tokenize(query) {
+		terms = append(terms, token.term)
+	}
+	if len(terms) == 0 {
+		return []SearchResult{}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	const k1, b = 1.2, 0.75
+	totalLength := 0
+	for _, doc := range s.docs {
+		totalLength += doc.Length
+	}
+	avgLength := float64(totalLength) / math.Max(1, float64(len(s.docs)))
+	scores := map[string]float64{}
+	var matched []string // every index term that matched, for highlighting
+	for i, term := range terms {
+		expansions := []string{term}
+		if i == len(terms)-1 {
+			expansions = expansions[:0]
+			for candidate := range s.postings {
+				if strings.HasPrefix(candidate, term) {
+					expansions = append(expansions, candidate)
+				}
+			}
+		}
+		termScores := map[string]float64{}
+		for _, expansion := range expansions {
+			docs := s.postings[expansion]
+			if len(docs) == 0 {
+				continue
+			}
+			matched = append(matched, expansion)
+			idf := math.Log(1 + (float64(len(s.docs))-float64(len(docs))+0.5)/(float64(len(docs))+0.5))
+			for id, freq := range docs {
+				tf := float64(freq)
+				norm := tf + k1*(1-b+b*float64(s.docs[id].Length)/avgLength)
+				termScores[id] = math.Max(termScores[id], idf*tf*(k1+1)/norm)
+			}
+		}
+		// Keep only documents that matched every term so far
+		if i == 0 {
+			scores = termScores
+			continue
+		}
+		for id := range scores {
+			if score, ok := termScores[id]; ok {
+				scores[id] += score
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		doc := s.docs[id]
+		results = append(results, SearchResult{
+			ID:      id,
+			Type:    doc.Type,
+			Title:   doc.Title,
+			Tags:    doc.Tags,
+			Score:   math.Round(score*1000) / 1000,
+			Excerpt: searchExcerpt(doc.Text, matched),
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Title < results[j].Title
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// Builds an HTML excerpt around the first match with every matching word in <mark>
+func searchExcerpt(text string, terms []string) string {
+	isMatch := map[string]bool{}
+	for _, term := range terms {
+		isMatch[term] = true
+	}
+	tokens := tokenize(text)
+	first := -1
+	for i, token := range tokens {
+		if isMatch[token.term] {
+			first = i
+			break
+		}
+	}
+	start, end := 0, min(len(text), searchExcerptLen)
+	if first >= 0 {
+		start = max(0, tokens[first].start-searchExcerptLen/3)
+		end = min(len(text), start+searchExcerptLen)
+	}
+	// Move the window onto rune boundaries
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+	var out strings.Builder
+	if start > 0 {
+		out.WriteString("…")
+	}
+	pos := start
+	for _, token := range tokens {
+		if token.start < start || token.end > end || !isMatch[token.term] {
+			continue
+		}
+		out.WriteString(html.EscapeString(text[pos:token.start]))
+		out.WriteString("<mark>" + html.EscapeString(text[token.start:token.end]) + "</mark>")
+		pos = token.end
+	}
+	out.WriteString(html.EscapeString(text[pos:end]))
+	if end < len(text) {
+		out.WriteString("…")
+	}
+	return strings.Join(strings.Fields(out.String()), " ")
+}
+
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	expirationTracker.CleanupExpired()
+	query := r.URL.Query().Get("q")
+	limit := 20
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = min(n, 100)
+	}
+	// Results are limited to the room the search was made in
+	room := roomFromRequest(r).Key()
+	tag := r.URL.Query().Get("tag")
+	device := deviceOwner(w, r)
+	results := []SearchResult{}
+	for _, result := range searchIndex.Search(query, math.MaxInt) {
+		if len(results) == limit {
+			break
+		}
+		if entryRoomKey(result.ID) == room && canSeeEntry(result.ID, device) && (tag == "" || slices.Contains(result.Tags, tag)) {
+			results = append(results, result)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(struct {
+		Query   string         `json:"query"`
+		Results []SearchResult `json:"results"`
+	}{query, results})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A file or snippet can be sent to one device that is following the room
+// instead of being shared with everyone in it. Only that device lists and
+// opens it, and it's asked to accept or decline. Sends that aren't accepted
+// in time expire, which SEND_PICKUP_WINDOW sets (like "30m" or "2h")
+const (
+	eventSendOffered  = "send.offered"
+	eventSendAccepted = "send.accepted"
+	eventSendDeclined = "send.declined"
+)
+
+var sendPickupWindow = "1d"
+
+type Send struct {
+	Sender    string    `json:"sender"` // device IDs as in presence
+	Recipient string    `json:"recipient"`
+	Expiry    string    `json:"expiry,omitempty"` // expiry option applied once accepted
+	Accepted  bool      `json:"accepted,omitempty"`
+	Offered   time.Time `json:"offered"`
+}
+
+type SendTracker struct {
+	Sends map[string]*Send `json:"sends"` // by entry ID
+	mu    sync.Mutex       // mutex for thread safety
+}
+
+var sendTracker *SendTracker
+
+func initSendPickupWindow() {
+	if raw := os.Getenv("SEND_PICKUP_WINDOW"); raw != "" {
+		sendPickupWindow = raw
+		log.Printf("SEND_PICKUP_WINDOW set to %s", parseCustomDuration(raw))
+	}
+}
+
+func initSendTracker() *SendTracker {
+	tracker := &SendTracker{
+		Sends: make(map[string]*Send),
+	}
+	sendsFile := filepath.Join("data", "sends.json")
+	if data, err := os.ReadFile(sendsFile); err == nil {
+		var storedTracker SendTracker
+		if err := json.Unmarshal(data, &storedTracker); err == nil && storedTracker.Sends != nil {
+			tracker.Sends = storedTracker.Sends
+		}
+	}
+	return tracker
+}
+
+// Returns a copy of an entry's send, or nil if it's shared with the room
+func (t *SendTracker) Get(id string) *Send {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	send, ok := t.Sends[id]
+	if !ok {
+		return nil
+	}
+	sendCopy := *send
+	return &sendCopy
+}
+
+func (t *SendTracker) Add(id string, send Send) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Sends[id] = &send
+	t.saveToFile()
+}
+
+// Marks a send as accepted, reporting false if there is no pending send
+func (t *SendTracker) Accept(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	send, ok := t.Sends[id]
+	if !ok || send.Accepted {
+		return false
+	}
+	send.Accepted = true
+	t.saveToFile()
+	return true
+}
+
+func (t *SendTracker) Remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.Sends[id]; ok {
+		delete(t.Sends, id)
+		t.saveToFile()
+	}
+}
+
+func (t *SendTracker) Rename(oldID, newID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	send, ok := t.Sends[oldID]
+	if !ok {
+		return
+	}
+	delete(t.Sends, oldID)
+	t.Sends[newID] = send
+	t.saveToFile()
+}
+
+func (t *SendTracker) saveToFile() {
+	data, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		log.Printf("Error marshaling sends: %v", err)
+		return
+	}
+	sendsFile := filepath.Join("data", "sends.json")
+	if err := os.WriteFile(sendsFile, data, 0644); err != nil {
+		log.Printf("Error saving sends: %v", err)
+	}
+}
+
+// Reports whether a device may list and open an entry
+func canSeeEntry(id, device string) bool {
+	send := sendTracker.Get(id)
+	return send == nil || send.Recipient == device
+}
+
+// Drops the entries sent to other devices
+func visibleEntries(entries []Entry, device string) []Entry {
+	visible := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if canSeeEntry(entry.ID, device) {
+			visible = append(visible, entry)
+		}
+	}
+	return visible
+}
+
+// Hides entries sent to other devices from paths like /download/<id>,
+// writing a not found error if it's not the recipient asking
+func checkEntryRecipient(w http.ResponseWriter, r *http.Request) bool {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) < 2 {
+		return true
+	}
+	send := sendTracker.Get(parts[1])
+	if send == nil || send.Recipient == deviceOwner(w, r) {
+		return true
+	}
+	http.Error(w, "Entry not found", http.StatusNotFound)
+	return false
+}
+
+// Reports whether a device is following a room's updates
+func deviceOnline(room, device string) bool {
+	for _, p := range hub.Presence(room).Devices {
+		if p.Device == device {
+			return p.Online
+		}
+	}
+	return false
+}
+
+// Records a new entry as sent to a device, before the entry is written. It
+// expires unless accepted within the pickup window, after which expiry (an
+// expiry option) applies
+func offerEntry(id, sender, recipient, expiry string) {
+	sendTracker.Add(id, Send{Sender: sender, Recipient: recipient, Expiry: expiry, Offered: time.Now()})
+	expirationTracker.SetExpiration(id, sendPickupWindow)
+}
+
+// Forgets an offer whose entry couldn't be written
+func withdrawOffer(id string) {
+	sendTracker.Remove(id)
+	expirationTracker.Remove(id)
+}
+
+// Payload of the send.* events
+type SendEvent struct {
+	ID       string     `json:"id"`
+	Room     string     `json:"room,omitempty"`
+	From     string     `json:"from,omitempty"` // sender's name, in offers
+	To       string     `json:"to,omitempty"`   // recipient's name, in replies
+	Entry    *Entry     `json:"entry,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"` // when an offer lapses
+	Accepted bool       `json:"accepted,omitempty"`
+}
+
+// Asks the recipient of a send to accept or decline it
+func publishSendOffered(id string) {
+	send := sendTracker.Get(id)
+	if send == nil {
+		return
+	}
+	payload := sendOfferPayload(id, send)
+	payload.Entry, _ = findEntry(id)
+	publishEvent(payload.Room, send.Recipient, eventSendOffered, payload)
+}
+
+// The send.offered payload apart from the entry
+func sendOfferPayload(id string, send *Send) SendEvent {
+	payload := SendEvent{ID: id, Room: entryRoomKey(id), From: deviceTracker.Name(send.Sender)}
+	if expiry, ok := expirationTracker.Get(id); ok {
+		payload.Expires = &expiry
+	}
+	return payload
+}
+
+// Tells the sender what became of a send
+func publishSendReply(id string, send *Send, accepted bool) {
+	event := eventSendDeclined
+	if accepted {
+		event = eventSendAccepted
+	}
+	payload := SendEvent{ID: id, Room: entryRoomKey(id), To: deviceTracker.Name(send.Recipient), Accepted: accepted}
+	publishEvent(payload.Room, send.Sender, event, payload)
+}
+
+// Accepts (POST /accept/<id>) or declines (POST /decline/<id>) an entry sent
+// to the requesting device. Declined entries are deleted
+func handleSendReply(accept bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		route := "/decline/"
+		if accept {
+			route = "/accept/"
+		}
+		id := strings.TrimPrefix(r.URL.Path, route)
+		send := sendTracker.Get(id)
+		if send == nil || send.Recipient != deviceOwner(w, r) {
+			http.Error(w, "Entry not found", http.StatusNotFound)
+			return
+		}
+		if send.Accepted {
+			http.Error(w, "This entry was already accepted", http.StatusConflict)
+			return
+		}
+		if accept {
+			if !sendTracker.Accept(id) {
+				http.Error(w, "This entry was already accepted", http.StatusConflict)
+				return
+			}
+			expirationTracker.SetExpiration(id, send.Expiry)
+			publishEntryEvent(eventEntryUpdated, id)
+			log.Printf("Accepted %s sent to %s\n", id, send.Recipient)
+		} else {
+			if err := deleteEntry(id); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to delete %s: %v", id, err)
+				http.Error(w, "Failed to delete the entry", http.StatusInternalServerError)
+				return
+			}
+			publishEntryRemoved(eventEntryDeleted, id, send)
+			log.Printf("Declined %s sent to %s\n", id, send.Recipient)
+		}
+		publishSendReply(id, send, accept)
+		notifyDevice(entryRoomKey(id), send.Recipient)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"accepted": accept})
+	}
+}
@@ -0,0 +1,53 @@
+// Shared Markdown rendering for the notepad and file previews. The source may
+// be an uploaded file, so raw HTML is shown as text and script URLs are dropped
+const markdownRenderer = new marked.Renderer();
+markdownRenderer.html = function(html) {
+  return html.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;')
+    .replace(/"/g, '&quot;').replace(/'/g, '&#39;');
+};
+
+function isSafeMarkdownURL(url, isImage) {
+  const normalized = url.replace(/[\u0000-\u0020\u007f]/g, '').toLowerCase();
+  if (isImage && /^data:image\/(png|gif|jpeg|webp);/.test(normalized)) {
+    return true;
+  }
+  return !/^(javascript|vbscript|data):/.test(normalized);
+}
+
+function renderMarkdown(source, target) {
+  marked.setOptions({
+    breaks: true,
+    gfm: true,
+    headerIds: true,
+    renderer: markdownRenderer,
+    highlight: function(code, language) {
+      if (language && hljs.getLanguage(language)) {
+        try {
+          return hljs.highlight(code, { language: language }).value;
+        } catch (err) {
+          console.error('Highlighting error:', err);
+        }
+      }
+      return hljs.highlightAuto(code).value;
+    }
+  });
+  const rendered = document.createElement('template');
+  rendered.innerHTML = marked.parse(source);
+  rendered.content.querySelectorAll('[href], [src]').forEach((element) => {
+    ['href', 'src'].forEach((attribute) => {
+      const url = element.getAttribute(attribute);
+      if (url !== null && !isSafeMarkdownURL(url, element.tagName === 'IMG')) {
+        element.removeAttribute(attribute);
+      }
+    });
+  });
+  target.replaceChildren(rendered.content);
+  target.querySelectorAll('pre code').forEach((block) => {
+    hljs.highlightElement(block);
+  });
+  const links = target.querySelectorAll('a');
+  links.forEach(link => {
+    link.setAttribute('target', 'blank');
+    link.setAttribute('rel', 'noopener noreferrer');
+  });
+}
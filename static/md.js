@@ -3,36 +3,76 @@ const markdownEditor = document.getElementById('markdown-editor');
 const markdownPreview = document.getElementById('markdown-preview');
 const toggleModeBtn = document.getElementById('toggle-mode');
 const editorContainer = document.getElementById('editor-container');
+const cursorLayer = document.getElementById('remote-cursors');
+const liveStatus = document.getElementById('live-status');
+const notepadSelect = document.getElementById('notepad-select');
+const notepadModal = document.getElementById('notepad-modal');
+const notepadForm = document.getElementById('notepad-form');
+
+// The notepad on this page, and where its room's URLs start
+const roomPath = document.body.dataset.roomPath;
+const notepadName = document.body.dataset.notepad;
 
 // State Variables
 let undoStack = [];
 let redoStack = [];
 let lastChange = '';
 let isReaderMode = false;
-let lastSaveTime = Date.now();
-let saveTimeout = null;
-let isDirty = false;
+
+// Live editing: local edits are sent as text operations over a WebSocket,
+// one at a time, and everyone's edits come back as notepad.op events in the
+// order the server applied them. The server saves the notepad itself
+const clientId = Math.random().toString(36).slice(2) + Date.now().toString(36);
+const cursorColors = ['var(--red)', 'var(--peach)', 'var(--green)', 'var(--teal)', 'var(--blue)', 'var(--mauve)', 'var(--pink)'];
+let notepadId = '';
+let notepadGone = false; // renamed or deleted elsewhere
+let session = '';
+let revision = 0;
+let outstanding = null; // the operation sent and not yet seen back
+let outstandingSent = false; // false once the connection it went out on is lost
+let base = ''; // the text once outstanding is applied; the editor adds unsent edits
+let socket = null;
+let syncing = false;
+let missedWhileSyncing = [];
+let commandRef = 0;
+const pendingCommands = new Map();
+const remoteCursors = new Map(); // by client
+let cursorTimeout = null;
+let cursorLayerText = ''; // the text the cursors were last placed in
 
 // Initialize Application
 document.addEventListener('DOMContentLoaded', function() {
   loadContent();
+  loadNotepads();
   setupEventListeners();
 });
 
-// Save state and schedule auto-save on input
+// Save state and send edits on input
 function setupEventListeners() {
   markdownEditor.addEventListener('input', function() {
     saveState();
-    isDirty = true;
-    scheduleAutoSave();
+    sendChanges();
+    scheduleCursor();
+    renderCursors();
   });
-  markdownEditor.addEventListener('keyup', scheduleAutoSave);
-  // Ensure content is saved before leaving the page
-  window.addEventListener('beforeunload', function() {
-    if (isDirty) {
-      saveContent();
-    }
+  ['keyup', 'click', 'select'].forEach(name => markdownEditor.addEventListener(name, scheduleCursor));
+  markdownEditor.addEventListener('scroll', () => { cursorLayer.scrollTop = markdownEditor.scrollTop; });
+  window.addEventListener('resize', renderCursors);
+  notepadSelect.addEventListener('change', () => {
+    window.location.href = notepadURL(notepadSelect.value);
   });
+  document.getElementById('notepad-cancel-button').addEventListener('click', () => notepadModal.classList.add('hidden'));
+  document.getElementById('notepad-modal-backdrop').addEventListener('click', () => notepadModal.classList.add('hidden'));
+  document.getElementById('notepad-delete-button').addEventListener('click', deleteNotepad);
+  // Cursors are repeated so others can tell who is still here
+  setInterval(() => {
+    sendCursor();
+    const now = Date.now();
+    for (const [client, cursor] of remoteCursors) {
+      if (now - cursor.seen > 60000) remoteCursors.delete(client);
+    }
+    renderCursors();
+  }, 20000);
   
   // Handle tab key for indentation in the editor
   markdownEditor.addEventListener('keydown', function(e) {
@@ -43,92 +83,270 @@ function setupEventListeners() {
       this.value = this.value.substring(0, start) + '  ' + this.value.substring(end);
       this.selectionStart = this.selectionEnd = start + 2;
       saveState();
-      isDirty = true;
-      scheduleAutoSave();
+      sendChanges();
     }
   });
 }
 
-// Load notepad content from the backend
+// Load notepad content from the backend, then follow everyone's edits
 function loadContent() {
-  fetch('/notepad/md.file')
+  fetch(`${roomPath}/notepad/${notepadName}.file`)
     .then(response => {
       if (!response.ok) {
         throw new Error('Network response was not ok');
       }
+      notepadId = response.headers.get('X-Entry-ID');
+      session = response.headers.get('X-Notepad-Session');
+      revision = parseInt(response.headers.get('X-Notepad-Revision'), 10) || 0;
       return response.text();
     })
     .then(content => {
-      markdownEditor.value = content;
+      markdownEditor.value = base = content;
       saveState(); // Initialize the undo/redo stacks with initial content
+      connectLive();
     })
     .catch(error => {
       console.error('Error loading notepad content:', error);
       saveState();
+      setLiveStatus(false, 'Could not load the notepad');
     });
 }
 
-// Save notepad content to the backend
-function saveContent() {
-  if (!isDirty) return; // Don't save if there are no changes
-  const content = markdownEditor.value;
-  fetch('/notepad/md.file', {
-    method: 'POST',
-    body: content,
-    headers: {
-      'Content-Type': 'text/plain'
-    }
-  })
-  .then(response => {
-    if (!response.ok) {
-      throw new Error('Network response was not ok');
+function setLiveStatus(live, message) {
+  liveStatus.innerHTML = `<i class="fas fa-circle text-xs ${live ? 'text-green' : 'text-overlay0'}"></i>`;
+  liveStatus.append(` ${message}`);
+}
+
+function connectLive() {
+  const url = new URL(`${roomPath}/api/ws`, window.location.href);
+  url.protocol = url.protocol === 'https:' ? 'wss:' : 'ws:';
+  socket = new WebSocket(url);
+  socket.onopen = () => {
+    setLiveStatus(true, 'Live');
+    syncLive();
+  };
+  socket.onmessage = event => {
+    const msg = JSON.parse(event.data);
+    if (msg.type === 'result' && pendingCommands.has(msg.ref)) {
+      pendingCommands.get(msg.ref)(msg);
+      pendingCommands.delete(msg.ref);
+    } else if (msg.type === 'event') {
+      handleLiveEvent(msg.event, msg.data);
     }
-    lastSaveTime = Date.now();
-    isDirty = false;
-    console.log('Content saved successfully');
-  })
-  .catch(error => {
-    console.error('Error saving content:', error);
-  });
+  };
+  socket.onclose = () => {
+    socket = null;
+    syncing = false;
+    outstandingSent = false;
+    pendingCommands.clear();
+    setLiveStatus(false, 'Offline, reconnecting');
+    setTimeout(connectLive, 2000);
+  };
 }
 
-// Schedule an auto-save after a period of inactivity
-function scheduleAutoSave() {
-  if (saveTimeout) {
-    clearTimeout(saveTimeout);
+function sendCommand(type, data) {
+  if (!socket || socket.readyState !== WebSocket.OPEN) {
+    return Promise.reject(new Error('Not connected'));
   }
-  saveTimeout = setTimeout(() => {
-    saveContent();
-  }, 2000);
+  const ref = String(++commandRef);
+  socket.send(JSON.stringify({ ref, type, notepad: notepadName, data }));
+  return new Promise(resolve => pendingCommands.set(ref, resolve));
 }
 
-// Update the preview pane with rendered markdown
-function updatePreview() {
-    marked.setOptions({
-      breaks: true,
-      gfm: true,
-      headerIds: true,
-      highlight: function(code, language) {
-        if (language && hljs.getLanguage(language)) {
-          try {
-            return hljs.highlight(code, { language: language }).value;
-          } catch (err) {
-            console.error('Highlighting error:', err);
-          }
-        }
-        return hljs.highlightAuto(code).value;
+function handleLiveEvent(name, data) {
+  if (name.startsWith('notepad.') && name !== 'notepad.op' && name !== 'notepad.cursor') {
+    handleNotepadEvent(name, data);
+    return;
+  }
+  if (!data || (data.id && data.id !== notepadId)) return;
+  if (name === 'notepad.op' && syncing) {
+    missedWhileSyncing.push(data);
+  } else if (name === 'notepad.op' && data.session === session) {
+    receiveRevision(data);
+  } else if (name === 'notepad.cursor' && data.client !== clientId) {
+    remoteCursors.set(data.client, { ...data, seen: Date.now() });
+    renderCursors();
+  } else if (name === 'presence.updated') {
+    const online = new Set(data.devices.filter(d => d.online).map(d => d.device));
+    for (const [client, cursor] of remoteCursors) {
+      if (!online.has(cursor.device)) remoteCursors.delete(client);
+    }
+    renderCursors();
+  }
+}
+
+// Catches up on the revisions missed while loading or disconnected, then
+// sends whatever is waiting. With discardEdits, starts over from the
+// server's text instead
+function syncLive(discardEdits = false) {
+  if (syncing) return;
+  syncing = true;
+  sendCommand('notepad.sync', { session: discardEdits ? '' : session, rev: revision })
+    .then(result => {
+      syncing = false;
+      if (!result.ok) throw new Error(result.error);
+      if (result.data.text !== undefined) {
+        resetTo(result.data, discardEdits);
+        missedWhileSyncing.filter(r => r.session === session).forEach(receiveRevision);
+        missedWhileSyncing = [];
+        return;
       }
+      result.data.ops.forEach(receiveRevision);
+      missedWhileSyncing.filter(r => r.session === session).forEach(receiveRevision);
+      missedWhileSyncing = [];
+      // An edit lost with the connection is sent again
+      if (outstanding && !outstandingSent) sendOutstanding();
+      sendChanges();
+    })
+    .catch(error => {
+      syncing = false;
+      missedWhileSyncing = [];
+      console.error('Error syncing notepad:', error);
     });
-    markdownPreview.innerHTML = marked.parse(markdownEditor.value);
-    markdownPreview.querySelectorAll('pre code').forEach((block) => {
-      hljs.highlightElement(block);
-    });
-    const links = markdownPreview.querySelectorAll('a');
-    links.forEach(link => {
-      link.setAttribute('target', 'blank');
-      link.setAttribute('rel', 'noopener noreferrer');
-    });
+}
+
+function receiveRevision(r) {
+  if (r.rev <= revision) return;
+  if (r.rev > revision + 1) {
+    syncLive();
+    return;
+  }
+  revision = r.rev;
+  if (outstanding && r.client === clientId) {
+    outstanding = null;
+    sendChanges();
+    return;
+  }
+  applyRemote(r.op);
+}
+
+// Applies someone else's edit under our own unconfirmed and unsent ones
+function applyRemote(op) {
+  if (outstanding) {
+    [outstanding, op] = textOpTransform(outstanding, op);
+  }
+  const [, editorOp] = textOpTransform(textOpReplace(base, markdownEditor.value), op);
+  base = textOpApply(op, base);
+  const start = markdownEditor.selectionStart;
+  const end = markdownEditor.selectionEnd;
+  const scrollTop = markdownEditor.scrollTop;
+  markdownEditor.value = textOpApply(editorOp, markdownEditor.value);
+  markdownEditor.setSelectionRange(textOpTransformIndex(editorOp, start), textOpTransformIndex(editorOp, end));
+  markdownEditor.scrollTop = scrollTop;
+  // Undo only steps through this device's edits since the last remote one
+  undoStack = [];
+  redoStack = [];
+  lastChange = markdownEditor.value;
+  if (isReaderMode) updatePreview();
+  renderCursors();
+}
+
+// Starts over from the server's text, keeping any edits of ours on top
+// unless they're discarded
+function resetTo(snapshot, discardEdits) {
+  session = snapshot.session;
+  revision = snapshot.rev;
+  outstanding = null;
+  base = snapshot.text;
+  if (discardEdits) {
+    markdownEditor.value = lastChange = base;
+    undoStack = [];
+    redoStack = [];
+    if (isReaderMode) updatePreview();
+    renderCursors();
+  }
+  sendChanges();
+}
+
+function sendChanges() {
+  if (outstanding || syncing || notepadGone || !socket || socket.readyState !== WebSocket.OPEN) return;
+  if (markdownEditor.value === base) return;
+  outstanding = textOpReplace(base, markdownEditor.value);
+  base = markdownEditor.value;
+  sendOutstanding();
+}
+
+function sendOutstanding() {
+  outstandingSent = true;
+  sendCommand('notepad.op', { session, rev: revision, op: outstanding, client: clientId })
+    .then(result => {
+      if (result.status === 409) {
+        resetTo(result.data, false);
+      } else if (!result.ok) {
+        // The edit was refused (too large, out of space), so it's undone here
+        console.error('Error saving notepad edit:', result.error);
+        setLiveStatus(true, `Live, last edit not saved: ${result.error}`);
+        outstanding = null;
+        syncLive(true);
+      }
+    })
+    .catch(error => console.error('Error sending notepad edit:', error));
+}
+
+function scheduleCursor() {
+  if (cursorTimeout) return;
+  cursorTimeout = setTimeout(() => {
+    cursorTimeout = null;
+    sendCursor();
+  }, 150);
+}
+
+function sendCursor() {
+  sendCommand('notepad.cursor', {
+    client: clientId,
+    start: markdownEditor.selectionStart,
+    end: markdownEditor.selectionEnd,
+  }).catch(() => {});
+}
+
+// Draws the others' cursors over a copy of the text laid out like the editor,
+// moving them along with edits made since they were placed
+function renderCursors() {
+  const text = markdownEditor.value;
+  if (text !== cursorLayerText) {
+    const op = textOpReplace(cursorLayerText, text);
+    for (const cursor of remoteCursors.values()) {
+      cursor.start = textOpTransformIndex(op, cursor.start);
+      cursor.end = textOpTransformIndex(op, cursor.end);
+    }
+    cursorLayerText = text;
   }
+  if (remoteCursors.size === 0) {
+    cursorLayer.replaceChildren();
+    return;
+  }
+  const cursors = [...remoteCursors.values()]
+    .map(cursor => ({ ...cursor, pos: Math.min(cursor.end, text.length) }))
+    .sort((a, b) => a.pos - b.pos);
+  const nodes = [];
+  let pos = 0;
+  for (const cursor of cursors) {
+    nodes.push(document.createTextNode(text.slice(pos, cursor.pos)));
+    pos = cursor.pos;
+    const color = cursorColors[[...cursor.device].reduce((sum, c) => sum + c.charCodeAt(0), 0) % cursorColors.length];
+    const caret = document.createElement('span');
+    caret.className = 'relative';
+    caret.style.borderLeft = `2px solid ${color}`;
+    caret.style.marginLeft = '-1px';
+    caret.style.marginRight = '-1px';
+    const label = document.createElement('span');
+    label.className = 'absolute left-0 -top-4 px-1 rounded text-xs whitespace-nowrap text-crust font-sans';
+    label.style.backgroundColor = color;
+    label.textContent = cursor.name;
+    caret.appendChild(label);
+    nodes.push(caret);
+  }
+  nodes.push(document.createTextNode(text.slice(pos) + '\n'));
+  cursorLayer.replaceChildren(...nodes);
+  // The editor's scrollbar narrows its text
+  cursorLayer.style.paddingRight = `calc(1rem + ${markdownEditor.offsetWidth - markdownEditor.clientWidth}px)`;
+  cursorLayer.scrollTop = markdownEditor.scrollTop;
+}
+
+// Update the preview pane with rendered markdown
+function updatePreview() {
+  renderMarkdown(markdownEditor.value, markdownPreview);
+}
 
 // Toggle between reader (preview-only) and writer (editor) mode
 function toggleMode() {
@@ -136,11 +354,13 @@ function toggleMode() {
   if (isReaderMode) {
     updatePreview();
     markdownEditor.classList.add('hidden');
+    cursorLayer.classList.add('hidden');
     markdownPreview.classList.remove('hidden');
     toggleModeBtn.innerHTML = '<i class="fas fa-pencil-alt text-subtext0"></i>';
     toggleModeBtn.title = "Write Mode";
   } else {
     markdownEditor.classList.remove('hidden');
+    cursorLayer.classList.remove('hidden');
     markdownPreview.classList.add('hidden');
     toggleModeBtn.innerHTML = '<i class="fas fa-book-reader text-subtext0"></i>';
     toggleModeBtn.title = "Reader Mode";
@@ -167,8 +387,7 @@ function undoChange() {
     const previousValue = undoStack.pop();
     markdownEditor.value = previousValue;
     lastChange = previousValue;
-    isDirty = true;
-    scheduleAutoSave();
+    sendChanges();
   }
 }
 
@@ -179,7 +398,81 @@ function redoChange() {
     const nextValue = redoStack.pop();
     markdownEditor.value = nextValue;
     lastChange = nextValue;
-    isDirty = true;
-    scheduleAutoSave();
+    sendChanges();
+  }
+}
+
+// Named notepads: the list to switch between, and the modal to create one
+// or change this one
+function notepadURL(name) {
+  return name === 'md' ? `${roomPath}/md` : `${roomPath}/md/${name}`;
+}
+
+function loadNotepads() {
+  fetch(`${roomPath}/api/notepads`)
+    .then(response => response.json())
+    .then(renderNotepads)
+    .catch(error => console.error('Error loading notepads:', error));
+}
+
+function renderNotepads(notepads) {
+  notepadSelect.replaceChildren(...notepads.map(notepad => {
+    const option = new Option(notepad.name === 'md' ? 'Notepad' : notepad.name, notepad.name);
+    option.selected = notepad.name === notepadName;
+    return option;
+  }));
+  notepadSelect.classList.toggle('hidden', notepads.length < 2);
+  const current = notepads.find(notepad => notepad.name === notepadName);
+  const expiry = document.getElementById('notepad-expiry');
+  if (current && current.expires) {
+    expiry.textContent = `Deleted ${new Date(current.expires).toLocaleString()}`;
+    expiry.title = 'This notepad expires then';
+  }
+  expiry.classList.toggle('hidden', !(current && current.expires));
+}
+
+function handleNotepadEvent(name, data) {
+  // Saves don't change the list
+  if (name === 'notepad.updated' && !data.previousId) return;
+  if (data.previousId === notepadId) {
+    // Renamed elsewhere, so this page moves with it
+    notepadGone = true;
+    window.location.replace(notepadURL(data.name));
+    return;
   }
+  if ((name === 'notepad.deleted' || name === 'notepad.expired') && data.id === notepadId) {
+    notepadGone = true;
+    markdownEditor.readOnly = true;
+    setLiveStatus(false, name === 'notepad.expired' ? 'This notepad expired' : 'This notepad was deleted');
+  }
+  loadNotepads();
+}
+
+function showNotepadModal(settings) {
+  document.getElementById('notepad-modal-title').textContent = settings ? 'Notepad Settings' : 'New Notepad';
+  notepadForm.action = settings ? `${roomPath}/notepads/${notepadName}` : `${roomPath}/notepads`;
+  const nameInput = document.getElementById('notepad-name-input');
+  nameInput.value = settings ? notepadName : '';
+  nameInput.required = !settings;
+  const expiryInput = document.getElementById('notepad-expiry-input');
+  expiryInput.value = '';
+  // Settings keep the current expiry unless a new one is given
+  expiryInput.placeholder = settings ? 'Unchanged' : 'Never';
+  document.getElementById('notepad-delete-button').classList.toggle('hidden', !settings);
+  notepadModal.classList.remove('hidden');
+  nameInput.focus();
+}
+
+function deleteNotepad() {
+  if (!confirm(`Delete the notepad "${notepadName}"? This can't be undone.`)) return;
+  fetch(`${roomPath}/notepads/${notepadName}/delete`, { method: 'POST' })
+    .then(response => {
+      if (response.ok) {
+        notepadGone = true;
+        window.location.href = notepadURL('md');
+      } else {
+        console.error('Failed to delete the notepad.');
+      }
+    })
+    .catch(error => console.error('Error deleting notepad:', error));
 }
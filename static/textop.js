@@ -0,0 +1,194 @@
+// Text operations as in textop.go (and ot.js): a list where a positive number
+// keeps that many characters, a negative one deletes them, and a string is
+// inserted. Lengths count UTF-16 code units, like JavaScript strings
+
+function textOpRetain(op, n) {
+  if (n <= 0) return op;
+  if (op.length && typeof op[op.length - 1] === 'number' && op[op.length - 1] > 0) {
+    op[op.length - 1] += n;
+  } else {
+    op.push(n);
+  }
+  return op;
+}
+
+// Inserts go before a delete at the same position, as on the server
+function textOpInsert(op, s) {
+  if (!s) return op;
+  const last = op.length - 1;
+  if (last >= 0 && typeof op[last] === 'string') {
+    op[last] += s;
+  } else if (last >= 0 && op[last] < 0) {
+    if (last > 0 && typeof op[last - 1] === 'string') {
+      op[last - 1] += s;
+    } else {
+      op.push(op[last]);
+      op[last] = s;
+    }
+  } else {
+    op.push(s);
+  }
+  return op;
+}
+
+function textOpDelete(op, n) {
+  if (n <= 0) return op;
+  if (op.length && typeof op[op.length - 1] === 'number' && op[op.length - 1] < 0) {
+    op[op.length - 1] -= n;
+  } else {
+    op.push(-n);
+  }
+  return op;
+}
+
+function textOpApply(op, text) {
+  let result = '';
+  let pos = 0;
+  for (const c of op) {
+    if (typeof c === 'string') {
+      result += c;
+    } else if (c > 0) {
+      if (pos + c > text.length) throw new Error('Operation does not match the text');
+      result += text.slice(pos, pos + c);
+      pos += c;
+    } else {
+      pos -= c;
+    }
+  }
+  if (pos !== text.length) throw new Error('Operation does not match the text');
+  return result;
+}
+
+// Transforms concurrent operations a and b into [a', b'] so that a then b'
+// equals b then a'. When both insert at the same position, a's text comes first
+function textOpTransform(a, b) {
+  const aPrime = [];
+  const bPrime = [];
+  let i = 0;
+  let j = 0;
+  let ca = a[i++];
+  let cb = b[j++];
+  while (ca !== undefined || cb !== undefined) {
+    if (typeof ca === 'string') {
+      textOpInsert(aPrime, ca);
+      textOpRetain(bPrime, ca.length);
+      ca = a[i++];
+      continue;
+    }
+    if (typeof cb === 'string') {
+      textOpRetain(aPrime, cb.length);
+      textOpInsert(bPrime, cb);
+      cb = b[j++];
+      continue;
+    }
+    if (ca === undefined || cb === undefined) {
+      throw new Error('Operations do not apply to the same text');
+    }
+    const n = Math.min(Math.abs(ca), Math.abs(cb));
+    if (ca > 0 && cb > 0) {
+      textOpRetain(aPrime, n);
+      textOpRetain(bPrime, n);
+    } else if (ca < 0 && cb > 0) {
+      textOpDelete(aPrime, n);
+    } else if (ca > 0 && cb < 0) {
+      textOpDelete(bPrime, n);
+    }
+    // Text both deleted is simply gone
+    ca = ca > 0 ? ca - n : ca + n;
+    cb = cb > 0 ? cb - n : cb + n;
+    if (ca === 0) ca = a[i++];
+    if (cb === 0) cb = b[j++];
+  }
+  return [aPrime, bPrime];
+}
+
+// An operation turning one text into another, replacing what lies between
+// their common prefix and suffix
+function textOpReplace(from, to) {
+  let prefix = 0;
+  while (prefix < from.length && prefix < to.length && from[prefix] === to[prefix]) {
+    prefix++;
+  }
+  let suffix = 0;
+  while (suffix < from.length - prefix && suffix < to.length - prefix &&
+         from[from.length - 1 - suffix] === to[to.length - 1 - suffix]) {
+    suffix++;
+  }
+  const op = [];
+  textOpRetain(op, prefix);
+  textOpInsert(op, to.slice(prefix, to.length - suffix));
+  textOpDelete(op, from.length - prefix - suffix);
+  textOpRetain(op, suffix);
+  return op;
+}
+
+// Where a position in the text ends up after the operation; text inserted
+// right at it pushes it along
+function textOpTransformIndex(op, index) {
+  let newIndex = index;
+  for (const c of op) {
+    if (typeof c === 'string') {
+      newIndex += c.length;
+    } else if (c > 0) {
+      index -= c;
+    } else {
+      newIndex -= Math.min(index, -c);
+      index += c;
+    }
+    if (index < 0) break;
+  }
+  return newIndex;
+}
+
+// Like textOpReplace, but keeps the lines the texts share, so separate edits
+// stay separate. Falls back to a single replacement for very long texts
+function textOpDiff(from, to) {
+  const split = text => text.match(/[^\n]*\n|[^\n]+$/g) || [];
+  const a = split(from);
+  const b = split(to);
+  let prefix = 0;
+  while (prefix < a.length && prefix < b.length && a[prefix] === b[prefix]) prefix++;
+  let suffix = 0;
+  while (suffix < a.length - prefix && suffix < b.length - prefix &&
+         a[a.length - 1 - suffix] === b[b.length - 1 - suffix]) {
+    suffix++;
+  }
+  const aMid = a.slice(prefix, a.length - suffix);
+  const bMid = b.slice(prefix, b.length - suffix);
+  const length = lines => lines.reduce((n, line) => n + line.length, 0);
+  const op = textOpRetain([], length(a.slice(0, prefix)));
+  if (aMid.length * bMid.length > 4000000) {
+    const tail = textOpReplace(aMid.join(''), bMid.join(''));
+    tail.forEach(c => typeof c === 'string' ? textOpInsert(op, c) : c > 0 ? textOpRetain(op, c) : textOpDelete(op, -c));
+    return textOpRetain(op, length(a.slice(a.length - suffix)));
+  }
+  // Longest common subsequence of the lines in between
+  const lcs = Array.from({ length: aMid.length + 1 }, () => new Uint32Array(bMid.length + 1));
+  for (let i = aMid.length - 1; i >= 0; i--) {
+    for (let j = bMid.length - 1; j >= 0; j--) {
+      lcs[i][j] = aMid[i] === bMid[j] ? lcs[i + 1][j + 1] + 1 : Math.max(lcs[i + 1][j], lcs[i][j + 1]);
+    }
+  }
+  let i = 0;
+  let j = 0;
+  while (i < aMid.length || j < bMid.length) {
+    if (i < aMid.length && j < bMid.length && aMid[i] === bMid[j]) {
+      textOpRetain(op, aMid[i++].length);
+      j++;
+    } else if (j < bMid.length && (i === aMid.length || lcs[i][j + 1] >= lcs[i + 1][j])) {
+      textOpInsert(op, bMid[j++]);
+    } else {
+      textOpDelete(op, aMid[i++].length);
+    }
+  }
+  return textOpRetain(op, length(a.slice(a.length - suffix)));
+}
+
+// Combines two texts edited separately from the same base. Where both changed
+// the same lines, both versions are kept, ours first
+function textOpMerge(base, ours, theirs) {
+  // Every line ends in a newline while merging, so the last ones compare equal
+  [base, ours, theirs] = [base + '\n', ours + '\n', theirs + '\n'];
+  const [, theirsAfterOurs] = textOpTransform(textOpDiff(base, ours), textOpDiff(base, theirs));
+  return textOpApply(theirsAfterOurs, ours).replace(/\n$/, '');
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxTagsPerEntry = 20
+	maxTagLength    = 32
+)
+
+type TagCount struct {
+	Name   string `json:"name"`
+	Count  int    `json:"count"`
+	Weight int    `json:"-"` // 1-3, for sizing the tag cloud
+}
+
+// Splits a comma or space separated tag list into normalised tags: lowercase,
+// without a leading '#', limited to letters, digits, '-', '_' and '.'
+func parseTags(raw string) []string {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, field := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		tag := strings.ToLower(strings.TrimLeft(field, "#"))
+		tag = strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+				return r
+			}
+			return -1
+		}, tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength {
+			tag = string([]rune(tag)[:maxTagLength])
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+		if len(tags) == maxTagsPerEntry {
+			break
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func entryTags(id string) []string {
+	if meta := metadataTracker.Get(id); meta != nil {
+		return meta.Tags
+	}
+	return nil
+}
+
+func setEntryTags(id string, tags []string) {
+	if len(tags) == 0 && metadataTracker.Get(id) == nil {
+		return
+	}
+	metadataTracker.Update(id, func(meta *EntryMeta) { meta.Tags = tags })
+}
+
+func hasTag(entry Entry, tag string) bool {
+	for _, t := range entry.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func filterEntriesByTag(entries []Entry, tag string) []Entry {
+	if tag == "" {
+		return entries
+	}
+	filtered := []Entry{}
+	for _, entry := range entries {
+		if hasTag(entry, tag) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// Counts tag usage across entries, most used first
+func tagCloud(entries []Entry) []TagCount {
+	counts := map[string]int{}
+	for _, entry := range entries {
+		for _, tag := range entry.Tags {
+			counts[tag]++
+		}
+	}
+	cloud := make([]TagCount, 0, len(counts))
+	maxCount := 0
+	for name, count := range counts {
+		cloud = append(cloud, TagCount{Name: name, Count: count})
+		maxCount = max(maxCount, count)
+	}
+	sort.Slice(cloud, func(i, j int) bool {
+		if cloud[i].Count != cloud[j].Count {
+			return cloud[i].Count > cloud[j].Count
+		}
+		return cloud[i].Name < cloud[j].Name
+	})
+	for i := range cloud {
+		switch {
+		case maxCount > 1 && cloud[i].Count*3 >= maxCount*2:
+			cloud[i].Weight = 3
+		case maxCount > 1 && cloud[i].Count*3 >= maxCount:
+			cloud[i].Weight = 2
+		default:
+			cloud[i].Weight = 1
+		}
+	}
+	return cloud
+}
+
+// Reports whether an entry ID refers to an existing snippet, file or link
+func entryExists(id string) bool {
+	_, local := splitEntryID(id)
+	if strings.HasPrefix(local, "link/") {
+		room, ok := entryRoom(id)
+		if !ok {
+			return false
+		}
+		for _, entry := range listEntries(room) {
+			if entry.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	if !strings.HasPrefix(local, "text/") && !strings.HasPrefix(local, "files/") {
+		return false
+	}
+	info, err := os.Stat(filepath.Join("data", id))
+	return err == nil && !info.IsDir()
+}
+
+// Lists all tags in use with their counts
+func handleTagList(w http.ResponseWriter, r *http.Request) {
+	expirationTracker.CleanupExpired()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(tagCloud(visibleEntries(listEntries(roomFromRequest(r)), deviceOwner(w, r))))
+}
+
+// Replaces an entry's tags with the "tags" form field
+func handleTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := entryIDFromPath(r, "/tags/")
+	if err != nil {
+		http.Error(w, "Invalid link", http.StatusBadRequest)
+		return
+	}
+	if !entryExists(id) {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	tags := parseTags(r.FormValue("tags"))
+	setEntryTags(id, tags)
+	searchIndex.Update(id)
+	publishEntryEvent(eventEntryUpdated, id)
+	notifyContentChange(entryRoomKey(id))
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tags)
+	} else {
+		http.Redirect(w, r, roomPath(entryRoomKey(id))+"/", http.StatusSeeOther)
+	}
+	log.Printf("Set tags for %s to %v\n", id, tags)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+// Text operations in the format of ot.js: a list of components where a
+// positive number keeps that many characters, a negative one deletes them,
+// and a string is inserted. Lengths are counted in UTF-16 code units, as
+// browsers count them, so documents are held as []uint16
+type TextOp []opComponent
+
+// One component; exactly one of the fields is set
+type opComponent struct {
+	retain int
+	delete int
+	insert []uint16
+}
+
+var errOpMismatch = errors.New("operation does not match the document")
+
+// Received operations may not span more than this many characters, which also
+// keeps lengths added up from them from overflowing
+const maxOpLength = 1 << 30
+
+// Appends a retain, merging it with a previous one
+func (op TextOp) Retain(n int) TextOp {
+	if n <= 0 {
+		return op
+	}
+	if last := len(op) - 1; last >= 0 && op[last].retain > 0 {
+		op[last].retain += n
+		return op
+	}
+	return append(op, opComponent{retain: n})
+}
+
+// Appends an insert. Inserts go before a delete at the same position, so
+// equivalent operations always look the same
+func (op TextOp) Insert(s []uint16) TextOp {
+	if len(s) == 0 {
+		return op
+	}
+	last := len(op) - 1
+	switch {
+	case last >= 0 && op[last].insert != nil:
+		op[last].insert = append(op[last].insert, s...)
+	case last >= 0 && op[last].delete > 0:
+		if last > 0 && op[last-1].insert != nil {
+			op[last-1].insert = append(op[last-1].insert, s...)
+		} else {
+			op = append(op, op[last])
+			op[last] = opComponent{insert: append([]uint16(nil), s...)}
+		}
+	default:
+		op = append(op, opComponent{insert: append([]uint16(nil), s...)})
+	}
+	return op
+}
+
+// Appends a delete, merging it with a previous one
+func (op TextOp) Delete(n int) TextOp {
+	if n <= 0 {
+		return op
+	}
+	if last := len(op) - 1; last >= 0 && op[last].delete > 0 {
+		op[last].delete += n
+		return op
+	}
+	return append(op, opComponent{delete: n})
+}
+
+// Length of the documents the operation applies to
+func (op TextOp) BaseLength() int {
+	n := 0
+	for _, c := range op {
+		n += c.retain + c.delete
+	}
+	return n
+}
+
+// Length of the documents the operation produces
+func (op TextOp) TargetLength() int {
+	n := 0
+	for _, c := range op {
+		n += c.retain + len(c.insert)
+	}
+	return n
+}
+
+// Reports whether the operation changes nothing
+func (op TextOp) IsNoop() bool {
+	return len(op) == 0 || (len(op) == 1 && op[0].retain > 0)
+}
+
+func (op TextOp) Apply(doc []uint16) ([]uint16, error) {
+	result := make([]uint16, 0, len(doc))
+	pos := 0
+	for _, c := range op {
+		switch {
+		case c.retain > 0:
+			if c.retain > len(doc)-pos {
+				return nil, errOpMismatch
+			}
+			result = append(result, doc[pos:pos+c.retain]...)
+			pos += c.retain
+		case c.delete > 0:
+			if c.delete > len(doc)-pos {
+				return nil, errOpMismatch
+			}
+			pos += c.delete
+		default:
+			result = append(result, c.insert...)
+		}
+	}
+	if pos != len(doc) {
+		return nil, errOpMismatch
+	}
+	return result, nil
+}
+
+// Transforms two operations made concurrently on the same document into a'
+// and b', so that applying a then b' gives the same result as b then a'.
+// When both insert at the same position, a's text comes first
+func TransformOps(a, b TextOp) (TextOp, TextOp, error) {
+	if a.BaseLength() != b.BaseLength() {
+		return nil, nil, errOpMismatch
+	}
+	var aPrime, bPrime TextOp
+	i, j := 0, 0
+	// What is left of the current components, which may be partly consumed
+	var ca, cb opComponent
+	next := func(op TextOp, k *int, c *opComponent) {
+		if *k < len(op) {
+			*c = op[*k]
+			*k++
+		} else {
+			*c = opComponent{}
+		}
+	}
+	done := func(c opComponent) bool { return c.retain == 0 && c.delete == 0 && c.insert == nil }
+	next(a, &i, &ca)
+	next(b, &j, &cb)
+	for !done(ca) || !done(cb) {
+		if ca.insert != nil {
+			aPrime = aPrime.Insert(ca.insert)
+			bPrime = bPrime.Retain(len(ca.insert))
+			next(a, &i, &ca)
+			continue
+		}
+		if cb.insert != nil {
+			aPrime = aPrime.Retain(len(cb.insert))
+			bPrime = bPrime.Insert(cb.insert)
+			next(b, &j, &cb)
+			continue
+		}
+		if done(ca) || done(cb) {
+			return nil, nil, errOpMismatch
+		}
+		n := min(ca.retain+ca.delete, cb.retain+cb.delete)
+		switch {
+		case ca.retain > 0 && cb.retain > 0:
+			aPrime = aPrime.Retain(n)
+			bPrime = bPrime.Retain(n)
+		case ca.delete > 0 && cb.retain > 0:
+			aPrime = aPrime.Delete(n)
+		case ca.retain > 0 && cb.delete > 0:
+			bPrime = bPrime.Delete(n)
+		}
+		// Text both deleted is simply gone
+		if ca.retain > 0 {
+			ca.retain -= n
+		} else {
+			ca.delete -= n
+		}
+		if cb.retain > 0 {
+			cb.retain -= n
+		} else {
+			cb.delete -= n
+		}
+		if ca.retain == 0 && ca.delete == 0 {
+			next(a, &i, &ca)
+		}
+		if cb.retain == 0 && cb.delete == 0 {
+			next(b, &j, &cb)
+		}
+	}
+	return aPrime, bPrime, nil
+}
+
+// An operation turning one text into another, replacing what lies between
+// their common prefix and suffix
+func ReplaceOp(from, to []uint16) TextOp {
+	prefix := 0
+	for prefix < len(from) && prefix < len(to) && from[prefix] == to[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(from)-prefix && suffix < len(to)-prefix && from[len(from)-1-suffix] == to[len(to)-1-suffix] {
+		suffix++
+	}
+	var op TextOp
+	op = op.Retain(prefix)
+	op = op.Insert(to[prefix : len(to)-suffix])
+	op = op.Delete(len(from) - prefix - suffix)
+	return op.Retain(suffix)
+}
+
+func (op TextOp) MarshalJSON() ([]byte, error) {
+	components := make([]any, len(op))
+	for i, c := range op {
+		switch {
+		case c.retain > 0:
+			components[i] = c.retain
+		case c.delete > 0:
+			components[i] = -c.delete
+		default:
+			components[i] = string(utf16.Decode(c.insert))
+		}
+	}
+	return json.Marshal(components)
+}
+
+func (op *TextOp) UnmarshalJSON(data []byte) error {
+	var components []json.RawMessage
+	if err := json.Unmarshal(data, &components); err != nil {
+		return err
+	}
+	var parsed TextOp
+	base := 0
+	for _, raw := range components {
+		if bytes.HasPrefix(bytes.TrimSpace(raw), []byte(`"`)) {
+			var s string
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return err
+			}
+			if s == "" {
+				return errors.New("empty insert in operation")
+			}
+			parsed = parsed.Insert(utf16.Encode([]rune(s)))
+			continue
+		}
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil || n == 0 {
+			return fmt.Errorf("invalid operation component %s", raw)
+		}
+		if n > maxOpLength || n < -maxOpLength || base+max(n, -n) > maxOpLength {
+			return fmt.Errorf("operation longer than %d characters", maxOpLength)
+		}
+		base += max(n, -n)
+		if n > 0 {
+			parsed = parsed.Retain(n)
+		} else {
+			parsed = parsed.Delete(-n)
+		}
+	}
+	*op = parsed
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// Thumbnails are cached as JPEGs in data/thumbs, mirroring the entry ID
+const (
+	thumbSize      = 256
+	thumbMaxPixels = 50_000_000 // refuse to decode anything larger (decompression bombs)
+)
+
+var (
+	errUnsupportedImage = errors.New("unsupported image format")
+	errImageTooLarge    = errors.New("image dimensions too large")
+)
+
+var (
+	thumbMu      sync.Mutex // serializes generation so large images don't pile up in memory
+	pdftoppmPath string     // empty when poppler is not installed
+)
+
+func initThumbnails() {
+	if err := os.MkdirAll(filepath.Join("data", "thumbs", "files"), 0755); err != nil {
+		log.Printf("Error creating thumbnail directory: %v", err)
+	}
+	if path, err := exec.LookPath("pdftoppm"); err == nil {
+		pdftoppmPath = path
+		log.Println("pdftoppm found, PDF thumbnails enabled.")
+	}
+}
+
+// Returns the URL of the thumbnail for a file entry, or "" if it cannot have one
+func thumbnailURL(id string) string {
+	if _, local := splitEntryID(id); !strings.HasPrefix(local, "files/") {
+		return ""
+	}
+	switch strings.ToLower(filepath.Ext(id)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return "/thumb/" + id
+	case ".pdf":
+		if pdftoppmPath != "" {
+			return "/thumb/" + id
+		}
+	}
+	return ""
+}
+
+func thumbnailPath(id string) string {
+	return filepath.Join("data", "thumbs", id+".jpg")
+}
+
+func removeThumbnail(id string) {
+	err := os.Remove(thumbnailPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing thumbnail for %s: %v", id, err)
+	}
+}
+
+// Returns the path of an up-to-date thumbnail, generating it if needed
+func ensureThumbnail(id string) (string, error) {
+	src := filepath.Join("data", id)
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	dst := thumbnailPath(id)
+	thumbMu.Lock()
+	defer thumbMu.Unlock()
+	if info, err := os.Stat(dst); err == nil && !info.ModTime().Before(srcInfo.ModTime()) {
+		return dst, nil
+	}
+	var data []byte
+	if strings.ToLower(filepath.Ext(id)) == ".pdf" {
+		data, err = renderPDFThumbnail(src)
+	} else {
+		data, err = renderImageThumbnail(src)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+func decodeImageFile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var decodeConfig func(r io.Reader) (image.Config, error)
+	var decode func(r io.Reader) (image.Image, error)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		decodeConfig, decode = jpeg.DecodeConfig, jpeg.Decode
+	case ".png":
+		decodeConfig, decode = png.DecodeConfig, png.Decode
+	case ".gif":
+		decodeConfig, decode = gif.DecodeConfig, gif.Decode // first frame only
+	case ".webp":
+		decodeConfig, decode = webp.DecodeConfig, webp.Decode
+	default:
+		return nil, errUnsupportedImage
+	}
+	cfg, err := decodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > thumbMaxPixels {
+		return nil, errImageTooLarge
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return decode(f)
+}
+
+func renderImageThumbnail(path string) ([]byte, error) {
+	img, err := decodeImageFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > thumbSize || h > thumbSize {
+		if w >= h {
+			w, h = thumbSize, max(1, h*thumbSize/w)
+		} else {
+			w, h = max(1, w*thumbSize/h), thumbSize
+		}
+	}
+	// Flatten transparency onto white since JPEG has no alpha
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	var thumb image.Image = dst
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".jpg" || ext == ".jpeg" {
+		thumb = applyOrientation(dst, jpegOrientation(path))
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Renders the first page of a PDF with poppler's pdftoppm
+func renderPDFThumbnail(path string) ([]byte, error) {
+	if pdftoppmPath == "" {
+		return nil, errUnsupportedImage
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, pdftoppmPath, "-f", "1", "-l", "1", "-singlefile",
+		"-scale-to", strconv.Itoa(thumbSize), "-jpeg", "-jpegopt", "quality=80", path)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Generates a thumbnail in the background so the first page load is fast
+func generateThumbnailAsync(id string) {
+	if thumbnailURL(id) == "" {
+		return
+	}
+	go func() {
+		if _, err := ensureThumbnail(id); err != nil {
+			log.Printf("Error generating thumbnail for %s: %v", id, err)
+		}
+	}()
+}
+
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/thumb/")
+	if thumbnailURL(id) == "" {
+		http.Error(w, "No thumbnail available", http.StatusNotFound)
+		return
+	}
+	path, err := ensureThumbnail(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error generating thumbnail for %s: %v", id, err)
+		http.Error(w, "Could not generate thumbnail", http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, path)
+}
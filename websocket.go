@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /api/ws carries the same messages as /api/updates over a WebSocket, and
+// takes commands in the other direction. Commands are run through the regular
+// HTTP handlers with the connection's cookies, so limits, quotas, and room
+// codes apply as they do to the HTTP API
+const (
+	wsMaxMessageSize = 64 << 20
+	wsPingInterval   = 20 * time.Second
+)
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+var errWSMessageTooLarge = errors.New("websocket message too large")
+
+// A command from a WebSocket client. Ref is echoed back in the result
+type wsCommand struct {
+	Ref        string `json:"ref,omitempty"`
+	Type       string `json:"type"` // snippet.create, link.create, entry.delete, notepad.update, or a notepad.op, .sync or .cursor
+	ID         string `json:"id,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Content    string `json:"content,omitempty"`
+	URL        string `json:"url,omitempty"`
+	Expiry     string `json:"expiry,omitempty"`
+	Tags       string `json:"tags,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	Confirm    string `json:"confirm,omitempty"`
+	Recipient  string `json:"recipient,omitempty"` // device to send a snippet to
+	Notepad    string `json:"notepad,omitempty"`   // name of the notepad, "md" if empty
+	// The request for the live notepad commands, as for /notepad/md.file/op
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type wsResult struct {
+	Type   string          `json:"type"` // always "result"
+	Ref    string          `json:"ref,omitempty"`
+	OK     bool            `json:"ok"`
+	Status int             `json:"status"`
+	IDs    []string        `json:"ids,omitempty"` // entries created
+	Error  string          `json:"error,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"` // JSON responses, like those of the live notepad
+}
+
+// An SSE message as sent over a WebSocket. Data is inlined when it's JSON
+type wsEvent struct {
+	Type  string `json:"type"` // always "event"
+	ID    uint64 `json:"id,omitempty"`
+	Event string `json:"event,omitempty"`
+	Data  any    `json:"data"`
+}
+
+func newWSEvent(msg sseMessage) wsEvent {
+	event := wsEvent{Type: "event", ID: msg.ID, Event: msg.Event, Data: msg.Data}
+	if json.Valid([]byte(msg.Data)) {
+		event.Data = json.RawMessage(msg.Data)
+	}
+	return event
+}
+
+type wsConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// Completes the WebSocket handshake and takes over the connection. Browsers
+// may only connect from pages served by this app
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != "GET" || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("not a websocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("invalid websocket key")
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "Cross-origin WebSocket connections are not allowed", http.StatusForbidden)
+			return nil, errors.New("cross-origin websocket")
+		}
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSockets are not supported here", http.StatusInternalServerError)
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := brw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reads the next text or binary message, answering pings along the way.
+// Returns io.EOF once the client closes the connection
+func (c *wsConn) ReadMessage() (int, []byte, error) {
+	var message []byte
+	opcode := -1
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsOpPing:
+			c.WriteMessage(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.WriteMessage(wsOpClose, payload[:min(len(payload), 2)])
+			return 0, nil, io.EOF
+		case wsOpContinuation:
+			if opcode < 0 {
+				return 0, nil, errors.New("unexpected continuation frame")
+			}
+		case wsOpText, wsOpBinary:
+			if opcode >= 0 {
+				return 0, nil, errors.New("expected a continuation frame")
+			}
+			opcode = op
+		default:
+			return 0, nil, fmt.Errorf("unknown opcode %d", op)
+		}
+		if len(message)+len(payload) > wsMaxMessageSize {
+			return 0, nil, errWSMessageTooLarge
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode int, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.br, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = int(header[0] & 0x0F)
+	if header[1]&0x80 == 0 {
+		err = errors.New("client frames must be masked")
+		return
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsOpClose && (length > 125 || !fin) {
+		err = errors.New("invalid control frame")
+		return
+	}
+	if length > wsMaxMessageSize {
+		err = errWSMessageTooLarge
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func (c *wsConn) WriteMessage(opcode int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	frame := []byte{0x80 | byte(opcode)}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+	_, err := c.conn.Write(append(frame, payload...))
+	return err
+}
+
+func (c *wsConn) WriteJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(wsOpText, data)
+}
+
+// Sends a close frame with a status code and closes the connection
+func (c *wsConn) Close(code uint16, reason string) {
+	c.WriteMessage(wsOpClose, append(binary.BigEndian.AppendUint16(nil, code), reason...))
+	c.conn.Close()
+}
+
+// Serves /api/ws. Accepts a lastEventId parameter to resume like /api/updates
+func handleWebSocket(handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		device := deviceOwner(w, r)
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		room := roomFromRequest(r)
+		sub, catchUp := hub.Subscribe(room.Key(), r.URL.Query().Get("lastEventId"), device, deviceTracker.Seen(device, r.UserAgent()))
+		defer hub.Unsubscribe(sub)
+
+		// Commands are read and run one at a time, in order
+		done := make(chan error, 1)
+		go func() {
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					done <- err
+					return
+				}
+				var cmd wsCommand
+				if err := json.Unmarshal(data, &cmd); err != nil {
+					conn.WriteJSON(wsResult{Type: "result", Status: http.StatusBadRequest, Error: "Invalid command: " + err.Error()})
+					continue
+				}
+				conn.WriteJSON(runWSCommand(handler, r, room, cmd))
+			}
+		}()
+
+		for _, msg := range catchUp {
+			if conn.WriteJSON(newWSEvent(msg)) != nil {
+				conn.conn.Close()
+				return
+			}
+		}
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			var err error
+			select {
+			case err := <-done:
+				if errors.Is(err, errWSMessageTooLarge) {
+					conn.Close(1009, "message too large")
+				} else if errors.Is(err, io.EOF) {
+					conn.conn.Close()
+				} else {
+					conn.Close(1002, "protocol error")
+				}
+				return
+			case <-sub.evicted:
+				log.Printf("Dropped WebSocket client %s that fell behind", r.RemoteAddr)
+				conn.Close(1013, "fell behind, reconnect with lastEventId")
+				return
+			case msg := <-sub.queue:
+				for _, msg := range sub.drain(msg) {
+					if err = conn.WriteJSON(newWSEvent(msg)); err != nil {
+						break
+					}
+				}
+			case <-ticker.C:
+				err = conn.WriteMessage(wsOpPing, nil)
+			}
+			if err != nil {
+				conn.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// Runs a command as the equivalent HTTP request from the same client
+func runWSCommand(handler http.Handler, r *http.Request, room *Room, cmd wsCommand) wsResult {
+	result := wsResult{Type: "result", Ref: cmd.Ref}
+	var target *url.URL
+	var body bytes.Buffer
+	contentType := "application/x-www-form-urlencoded"
+	switch cmd.Type {
+	case "snippet.create", "link.create":
+		form := multipart.NewWriter(&body)
+		if cmd.Type == "link.create" {
+			form.WriteField("type", "link")
+			form.WriteField("content", cmd.URL)
+		} else {
+			form.WriteField("type", "text")
+			form.WriteField("content", cmd.Content)
+			form.WriteField("name", cmd.Name)
+			form.WriteField("expiry", cmd.Expiry)
+			form.WriteField("recipient", cmd.Recipient)
+		}
+		form.WriteField("tags", cmd.Tags)
+		form.WriteField("collection", cmd.Collection)
+		form.Close()
+		contentType = form.FormDataContentType()
+		target = &url.URL{Path: room.Path() + "/submit"}
+	case "entry.delete":
+		target = entryURL("/delete/", cmd.ID)
+		body.WriteString(url.Values{"confirm": {cmd.Confirm}}.Encode())
+	case "notepad.update":
+		target = &url.URL{Path: room.Path() + "/notepad/" + cmd.notepadFile()}
+		contentType = "text/plain; charset=utf-8"
+		body.WriteString(cmd.Content)
+	case "notepad.op", "notepad.sync", "notepad.cursor":
+		target = &url.URL{Path: room.Path() + "/notepad/" + cmd.notepadFile() + "/" + strings.TrimPrefix(cmd.Type, "notepad.")}
+		contentType = "application/json"
+		body.Write(cmd.Data)
+	default:
+		result.Status = http.StatusBadRequest
+		result.Error = fmt.Sprintf("unknown command %q", cmd.Type)
+		return result
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), "POST", "/", &body)
+	if err != nil {
+		result.Status = http.StatusInternalServerError
+		result.Error = err.Error()
+		return result
+	}
+	req.URL = target
+	req.Host = r.Host
+	req.RemoteAddr = r.RemoteAddr
+	req.Header = r.Header.Clone()
+	for _, name := range []string{"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Sec-Websocket-Protocol"} {
+		req.Header.Del(name)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	req.ContentLength = int64(body.Len())
+
+	rec := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+	handler.ServeHTTP(rec, req)
+	result.Status = rec.status
+	result.OK = rec.status < 300
+	result.IDs = rec.header.Values("X-Entry-ID")
+	if strings.HasPrefix(rec.header.Get("Content-Type"), "application/json") && json.Valid(rec.body.Bytes()) {
+		result.Data = json.RawMessage(rec.body.Bytes())
+		if !result.OK {
+			result.Error = http.StatusText(rec.status)
+		}
+	} else if !result.OK {
+		result.Error = strings.TrimSpace(rec.body.String())
+	}
+	return result
+}
+
+func (cmd wsCommand) notepadFile() string {
+	if cmd.Notepad == "" {
+		return defaultNotepad + notepadFileExtension
+	}
+	return cmd.Notepad + notepadFileExtension
+}
+
+// The URL of an entry route such as /delete/ for an entry ID, escaped the way
+// the page's links are
+func entryURL(route, id string) *url.URL {
+	if path, err := url.PathUnescape(id); err == nil {
+		return &url.URL{Path: route + path, RawPath: route + id}
+	}
+	return &url.URL{Path: route + id}
+}
+
+// Captures the response of a handler run on behalf of a WebSocket command
+type responseRecorder struct {
+	header      http.Header
+	status      int
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (rec *responseRecorder) Header() http.Header { return rec.header }
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = status, true
+	}
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.body.Write(p)
+}